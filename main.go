@@ -4,18 +4,32 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/wearefair/log-aggregator/pkg/cursor"
 	"github.com/wearefair/log-aggregator/pkg/destinations"
+	"github.com/wearefair/log-aggregator/pkg/destinations/file"
 	"github.com/wearefair/log-aggregator/pkg/destinations/firehose"
+	"github.com/wearefair/log-aggregator/pkg/destinations/forward"
+	"github.com/wearefair/log-aggregator/pkg/destinations/http"
+	"github.com/wearefair/log-aggregator/pkg/destinations/kafka"
+	"github.com/wearefair/log-aggregator/pkg/destinations/otlp"
+	"github.com/wearefair/log-aggregator/pkg/destinations/s3"
 	"github.com/wearefair/log-aggregator/pkg/destinations/stdout"
+	"github.com/wearefair/log-aggregator/pkg/destinations/syslog"
 	"github.com/wearefair/log-aggregator/pkg/pipeline"
 	"github.com/wearefair/log-aggregator/pkg/sources"
+	"github.com/wearefair/log-aggregator/pkg/sources/cri"
+	"github.com/wearefair/log-aggregator/pkg/sources/docker"
+	sforward "github.com/wearefair/log-aggregator/pkg/sources/forward"
+	shttp "github.com/wearefair/log-aggregator/pkg/sources/http"
 	sjournal "github.com/wearefair/log-aggregator/pkg/sources/journal"
 	"github.com/wearefair/log-aggregator/pkg/sources/mock"
 	"github.com/wearefair/log-aggregator/pkg/transform"
 	"github.com/wearefair/log-aggregator/pkg/transform/aws"
+	"github.com/wearefair/log-aggregator/pkg/transform/ecs"
 	"github.com/wearefair/log-aggregator/pkg/transform/journal"
 	"github.com/wearefair/log-aggregator/pkg/transform/json"
 	"github.com/wearefair/log-aggregator/pkg/transform/k8"
@@ -25,11 +39,63 @@ import (
 const (
 	EnvK8ConfigPath                = "FAIR_LOG_K8_CONFIG_PATH"
 	EnvK8Regex                     = "FAIR_LOG_K8_CONTAINER_NAME_REGEX"
+	EnvK8Annotations               = "FAIR_LOG_K8_ANNOTATIONS"
+	EnvK8KubeletURL                = "FAIR_LOG_K8_KUBELET_URL"
+	EnvK8InCluster                 = "FAIR_LOG_K8_IN_CLUSTER"
+	EnvK8DockerSocket              = "FAIR_LOG_K8_DOCKER_SOCKET"
+	EnvK8DockerLabels              = "FAIR_LOG_K8_DOCKER_LABELS"
+	EnvAWSMetadataEndpoint         = "FAIR_LOG_AWS_METADATA_ENDPOINT"
+	EnvAWSMetadataDisabled         = "FAIR_LOG_AWS_METADATA_DISABLED"
+	EnvAWSInstanceTags             = "FAIR_LOG_AWS_INSTANCE_TAGS"
 	EnvCursorPath                  = "FAIR_LOG_CURSOR_PATH"
 	EnvMockSource                  = "FAIR_LOG_MOCK_SOURCE"
 	EnvMockDestination             = "FAIR_LOG_MOCK_DESTINATION"
 	EnvFirehoseStream              = "FAIR_LOG_FIREHOSE_STREAM"
 	EnvFirehoseCredentialsEndpoint = "FAIR_LOG_FIREHOSE_CREDENTIALS_ENDPOINT"
+	EnvDestination                 = "FAIR_LOG_DESTINATION"
+	EnvSource                      = "FAIR_LOG_SOURCE"
+	EnvJournalDirectories          = "FAIR_LOG_JOURNAL_DIRECTORIES"
+	EnvJournalFiles                = "FAIR_LOG_JOURNAL_FILES"
+	EnvJournalNamespaces           = "FAIR_LOG_JOURNAL_NAMESPACES"
+	EnvJournalMatches              = "FAIR_LOG_JOURNAL_MATCHES"
+	EnvJournalStart                = "FAIR_LOG_JOURNAL_START"
+	EnvJournalIncludeFields        = "FAIR_LOG_JOURNAL_INCLUDE_FIELDS"
+	EnvJournalExcludeFields        = "FAIR_LOG_JOURNAL_EXCLUDE_FIELDS"
+	EnvForwardListenAddress        = "FAIR_LOG_FORWARD_LISTEN_ADDRESS"
+	EnvForwardMaxMessageSize       = "FAIR_LOG_FORWARD_MAX_MESSAGE_SIZE"
+	EnvHTTPListenAddress           = "FAIR_LOG_HTTP_LISTEN_ADDRESS"
+	EnvCRILogDirectory             = "FAIR_LOG_CRI_LOG_DIRECTORY"
+	EnvDockerContainerDirectory    = "FAIR_LOG_DOCKER_CONTAINER_DIRECTORY"
+	EnvDockerLabels                = "FAIR_LOG_DOCKER_LABELS"
+	EnvS3Bucket                    = "FAIR_LOG_S3_BUCKET"
+	EnvS3KeyTemplate               = "FAIR_LOG_S3_KEY_TEMPLATE"
+	EnvKafkaBrokers                = "FAIR_LOG_KAFKA_BROKERS"
+	EnvKafkaTopicTemplate          = "FAIR_LOG_KAFKA_TOPIC_TEMPLATE"
+	EnvKafkaKeyField               = "FAIR_LOG_KAFKA_KEY_FIELD"
+	EnvKafkaCompression            = "FAIR_LOG_KAFKA_COMPRESSION"
+	EnvKafkaVersion                = "FAIR_LOG_KAFKA_VERSION"
+	EnvFilePath                    = "FAIR_LOG_FILE_PATH"
+	EnvFileGzip                    = "FAIR_LOG_FILE_GZIP"
+	EnvHTTPURL                     = "FAIR_LOG_HTTP_URL"
+	EnvHTTPFormat                  = "FAIR_LOG_HTTP_FORMAT"
+	EnvHTTPGzip                    = "FAIR_LOG_HTTP_GZIP"
+	EnvHTTPUsername                = "FAIR_LOG_HTTP_USERNAME"
+	EnvHTTPPassword                = "FAIR_LOG_HTTP_PASSWORD"
+	EnvHTTPBearerToken             = "FAIR_LOG_HTTP_BEARER_TOKEN"
+	EnvHTTPHeaders                 = "FAIR_LOG_HTTP_HEADERS"
+	EnvHTTPRetryableStatusCodes    = "FAIR_LOG_HTTP_RETRYABLE_STATUS_CODES"
+	EnvHTTPTimeout                 = "FAIR_LOG_HTTP_TIMEOUT"
+	EnvForwardAddress              = "FAIR_LOG_FORWARD_ADDRESS"
+	EnvForwardTagTemplate          = "FAIR_LOG_FORWARD_TAG_TEMPLATE"
+	EnvForwardCompress             = "FAIR_LOG_FORWARD_COMPRESS"
+	EnvForwardDisableAck           = "FAIR_LOG_FORWARD_DISABLE_ACK"
+	EnvOTLPProtocol                = "FAIR_LOG_OTLP_PROTOCOL"
+	EnvOTLPEndpoint                = "FAIR_LOG_OTLP_ENDPOINT"
+	EnvOTLPInsecure                = "FAIR_LOG_OTLP_INSECURE"
+	EnvOTLPGzip                    = "FAIR_LOG_OTLP_GZIP"
+	EnvSyslogNetwork               = "FAIR_LOG_SYSLOG_NETWORK"
+	EnvSyslogAddress               = "FAIR_LOG_SYSLOG_ADDRESS"
+	EnvSyslogStructuredDataFields  = "FAIR_LOG_SYSLOG_STRUCTURED_DATA_FIELDS"
 	EnvK8NodeName                  = "EC2_METADATA_LOCAL_HOSTNAME"
 )
 
@@ -39,6 +105,7 @@ func main() {
 	var destination destinations.Destination
 	var logCursor cursor.DB
 	var transformers []transform.Transformer
+	var flushers []transform.Flusher
 
 	// Setup cursor
 	if cursorPath := os.Getenv(EnvCursorPath); cursorPath == "" {
@@ -54,26 +121,14 @@ func main() {
 	if os.Getenv(EnvMockSource) == "true" {
 		source = mock.New(time.Second * 2)
 	} else {
-		source, err = sjournal.New(sjournal.ClientConfig{
-			Cursor: logCursor.Cursor(),
-		})
-		if err != nil {
-			panic(err)
-		}
+		source = newSource(os.Getenv(EnvSource), logCursor)
 	}
 
 	// Setup destination
 	if os.Getenv(EnvMockDestination) == "true" {
 		destination = stdout.New()
 	} else {
-		streamName := os.Getenv(EnvFirehoseStream)
-		if streamName == "" {
-			log.Fatalf("%s must be set", EnvFirehoseStream)
-		}
-		destination = firehose.New(firehose.Config{
-			EC2MetadataEndpoint: os.Getenv(EnvFirehoseCredentialsEndpoint),
-			FirehoseStream:      streamName,
-		})
+		destination = newDestination(os.Getenv(EnvDestination))
 	}
 
 	// Setup transformer pipeline
@@ -81,17 +136,47 @@ func main() {
 		journal.Transform,
 		json.Transform,
 		kibana.Transform,
-		aws.New(),
 	}
 
-	if configPath := os.Getenv(EnvK8ConfigPath); configPath != "" {
+	var instanceTags []string
+	if value := os.Getenv(EnvAWSInstanceTags); value != "" {
+		instanceTags = strings.Split(value, ",")
+	}
+	transformers = append(transformers, aws.New(aws.Config{
+		Endpoint: os.Getenv(EnvAWSMetadataEndpoint),
+		Disabled: os.Getenv(EnvAWSMetadataDisabled) == "true",
+		Tags:     instanceTags,
+	}).Transform)
+
+	// Set by the ECS agent when running in an ECS task
+	if endpoint := os.Getenv(ecs.EnvMetadataURI); endpoint != "" {
+		transformers = append(transformers, ecs.New(ecs.Config{Endpoint: endpoint}).Transform)
+	}
+
+	configPath := os.Getenv(EnvK8ConfigPath)
+	inCluster := os.Getenv(EnvK8InCluster) == "true"
+	if configPath != "" || inCluster {
+		var annotations []string
+		if value := os.Getenv(EnvK8Annotations); value != "" {
+			annotations = strings.Split(value, ",")
+		}
+		var dockerLabels []string
+		if value := os.Getenv(EnvK8DockerLabels); value != "" {
+			dockerLabels = strings.Split(value, ",")
+		}
 		k8Transformer := k8.New(k8.Config{
 			K8ConfigPath:                  configPath,
+			InCluster:                     inCluster,
 			NodeName:                      os.Getenv(EnvK8NodeName),
 			MaxPodsCache:                  100,
 			KubernetesContainerNameRegexp: os.Getenv(EnvK8Regex),
+			Annotations:                   annotations,
+			KubeletURL:                    os.Getenv(EnvK8KubeletURL),
+			DockerSocket:                  os.Getenv(EnvK8DockerSocket),
+			DockerLabels:                  dockerLabels,
 		})
 		transformers = append(transformers, k8Transformer.Transform)
+		flushers = append(flushers, k8Transformer)
 	}
 
 	logPipeline, err := pipeline.New(pipeline.Config{
@@ -100,6 +185,7 @@ func main() {
 		Input:        source,
 		Destination:  destination,
 		Transformers: transformers,
+		Flushers:     flushers,
 	})
 	if err != nil {
 		panic(err)
@@ -111,3 +197,254 @@ func main() {
 	<-signals
 	logPipeline.Stop(time.Second * 30)
 }
+
+func newSource(name string, logCursor cursor.DB) sources.Source {
+	switch name {
+	case "", "journal":
+		start, since, err := sjournal.ParseStart(os.Getenv(EnvJournalStart))
+		if err != nil {
+			panic(err)
+		}
+		conf := sjournal.ClientConfig{
+			Cursor:  logCursor.Cursor(),
+			Matches: strings.Fields(os.Getenv(EnvJournalMatches)),
+			Start:   start,
+			Since:   since,
+		}
+		if value := os.Getenv(EnvJournalDirectories); value != "" {
+			conf.JournalDirectories = strings.Split(value, ",")
+		}
+		if value := os.Getenv(EnvJournalFiles); value != "" {
+			conf.JournalFiles = strings.Split(value, ",")
+		}
+		if value := os.Getenv(EnvJournalNamespaces); value != "" {
+			conf.Namespaces = strings.Split(value, ",")
+		}
+		if value := os.Getenv(EnvJournalIncludeFields); value != "" {
+			conf.IncludeFields = strings.Split(value, ",")
+		}
+		// Set but empty forwards every field.
+		if value, ok := os.LookupEnv(EnvJournalExcludeFields); ok {
+			conf.ExcludeFields = []string{}
+			if value != "" {
+				conf.ExcludeFields = strings.Split(value, ",")
+			}
+		} else if os.Getenv(EnvK8ConfigPath) != "" || os.Getenv(EnvK8InCluster) == "true" {
+			// The k8 transformer finds the pods of containerd and CRI-O containers by their cgroup.
+			for _, field := range sjournal.DefaultExcludeFields {
+				if field != "_SYSTEMD_CGROUP" {
+					conf.ExcludeFields = append(conf.ExcludeFields, field)
+				}
+			}
+		}
+		source, err := sjournal.New(conf)
+		if err != nil {
+			panic(err)
+		}
+		return source
+
+	case "docker":
+		var labels []string
+		if value := os.Getenv(EnvDockerLabels); value != "" {
+			labels = strings.Split(value, ",")
+		}
+		source, err := docker.New(docker.Config{
+			Directory: os.Getenv(EnvDockerContainerDirectory),
+			Cursor:    logCursor.Cursor(),
+			Labels:    labels,
+		})
+		if err != nil {
+			panic(err)
+		}
+		return source
+
+	case "forward":
+		var maxMessageSize int
+		if val := os.Getenv(EnvForwardMaxMessageSize); val != "" {
+			var err error
+			if maxMessageSize, err = strconv.Atoi(val); err != nil {
+				log.Fatalf("Invalid %s: %s", EnvForwardMaxMessageSize, val)
+			}
+		}
+		source, err := sforward.New(sforward.Config{
+			Address:        os.Getenv(EnvForwardListenAddress),
+			MaxMessageSize: maxMessageSize,
+		})
+		if err != nil {
+			panic(err)
+		}
+		return source
+
+	case "http":
+		source, err := shttp.New(shttp.Config{
+			Address: os.Getenv(EnvHTTPListenAddress),
+		})
+		if err != nil {
+			panic(err)
+		}
+		return source
+
+	case "cri":
+		source, err := cri.New(cri.Config{
+			Directory: os.Getenv(EnvCRILogDirectory),
+			Cursor:    logCursor.Cursor(),
+		})
+		if err != nil {
+			panic(err)
+		}
+		return source
+
+	default:
+		log.Fatalf("Unknown %s: %s", EnvSource, name)
+	}
+	return nil
+}
+
+func newDestination(name string) destinations.Destination {
+	switch name {
+	case "", "firehose":
+		streamName := os.Getenv(EnvFirehoseStream)
+		if streamName == "" {
+			log.Fatalf("%s must be set", EnvFirehoseStream)
+		}
+		return firehose.New(firehose.Config{
+			EC2MetadataEndpoint: os.Getenv(EnvFirehoseCredentialsEndpoint),
+			FirehoseStream:      streamName,
+		})
+
+	case "s3":
+		bucket := os.Getenv(EnvS3Bucket)
+		if bucket == "" {
+			log.Fatalf("%s must be set", EnvS3Bucket)
+		}
+		return s3.New(s3.Config{
+			EC2MetadataEndpoint: os.Getenv(EnvFirehoseCredentialsEndpoint),
+			Bucket:              bucket,
+			KeyTemplate:         os.Getenv(EnvS3KeyTemplate),
+		})
+
+	case "kafka":
+		brokers := os.Getenv(EnvKafkaBrokers)
+		if brokers == "" {
+			log.Fatalf("%s must be set", EnvKafkaBrokers)
+		}
+		destination, err := kafka.New(kafka.Config{
+			Brokers:       strings.Split(brokers, ","),
+			TopicTemplate: os.Getenv(EnvKafkaTopicTemplate),
+			KeyField:      os.Getenv(EnvKafkaKeyField),
+			Compression:   os.Getenv(EnvKafkaCompression),
+			Version:       os.Getenv(EnvKafkaVersion),
+		})
+		if err != nil {
+			panic(err)
+		}
+		return destination
+
+	case "file":
+		path := os.Getenv(EnvFilePath)
+		if path == "" {
+			log.Fatalf("%s must be set", EnvFilePath)
+		}
+		return file.New(file.Config{
+			Path: path,
+			Gzip: os.Getenv(EnvFileGzip) == "true",
+		})
+
+	case "http":
+		// Headers are comma separated Name:value pairs
+		var headers map[string]string
+		if value := os.Getenv(EnvHTTPHeaders); value != "" {
+			headers = make(map[string]string)
+			for _, header := range strings.Split(value, ",") {
+				parts := strings.SplitN(header, ":", 2)
+				if len(parts) != 2 {
+					log.Fatalf("Invalid header in %s: %s", EnvHTTPHeaders, header)
+				}
+				headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+			}
+		}
+		var retryableStatusCodes []int
+		if value := os.Getenv(EnvHTTPRetryableStatusCodes); value != "" {
+			for _, code := range strings.Split(value, ",") {
+				parsed, err := strconv.Atoi(strings.TrimSpace(code))
+				if err != nil {
+					log.Fatalf("Invalid status code in %s: %s", EnvHTTPRetryableStatusCodes, code)
+				}
+				retryableStatusCodes = append(retryableStatusCodes, parsed)
+			}
+		}
+		var timeout time.Duration
+		if value := os.Getenv(EnvHTTPTimeout); value != "" {
+			var err error
+			if timeout, err = time.ParseDuration(value); err != nil {
+				log.Fatalf("Invalid %s: %s", EnvHTTPTimeout, value)
+			}
+		}
+		destination, err := http.New(http.Config{
+			URL:                  os.Getenv(EnvHTTPURL),
+			Format:               os.Getenv(EnvHTTPFormat),
+			Headers:              headers,
+			Gzip:                 os.Getenv(EnvHTTPGzip) == "true",
+			Username:             os.Getenv(EnvHTTPUsername),
+			Password:             os.Getenv(EnvHTTPPassword),
+			BearerToken:          os.Getenv(EnvHTTPBearerToken),
+			RetryableStatusCodes: retryableStatusCodes,
+			Timeout:              timeout,
+		})
+		if err != nil {
+			panic(err)
+		}
+		return destination
+
+	case "forward":
+		address := os.Getenv(EnvForwardAddress)
+		if address == "" {
+			log.Fatalf("%s must be set", EnvForwardAddress)
+		}
+		destination, err := forward.New(forward.Config{
+			Address:     address,
+			TagTemplate: os.Getenv(EnvForwardTagTemplate),
+			Compress:    os.Getenv(EnvForwardCompress) == "true",
+			DisableAck:  os.Getenv(EnvForwardDisableAck) == "true",
+		})
+		if err != nil {
+			panic(err)
+		}
+		return destination
+
+	case "otlp":
+		destination, err := otlp.New(otlp.Config{
+			Protocol: os.Getenv(EnvOTLPProtocol),
+			Endpoint: os.Getenv(EnvOTLPEndpoint),
+			Insecure: os.Getenv(EnvOTLPInsecure) == "true",
+			Gzip:     os.Getenv(EnvOTLPGzip) == "true",
+		})
+		if err != nil {
+			panic(err)
+		}
+		return destination
+
+	case "syslog":
+		address := os.Getenv(EnvSyslogAddress)
+		if address == "" {
+			log.Fatalf("%s must be set", EnvSyslogAddress)
+		}
+		var sdFields []string
+		if fields := os.Getenv(EnvSyslogStructuredDataFields); fields != "" {
+			sdFields = strings.Split(fields, ",")
+		}
+		destination, err := syslog.New(syslog.Config{
+			Network:              os.Getenv(EnvSyslogNetwork),
+			Address:              address,
+			StructuredDataFields: sdFields,
+		})
+		if err != nil {
+			panic(err)
+		}
+		return destination
+
+	default:
+		log.Fatalf("Unknown %s: %s", EnvDestination, name)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Package awsutil contains helpers shared by the destinations that talk to AWS.
+package awsutil
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// NewSession returns an aws session.
+// If ec2MetadataEndpoint is not empty, it overrides the metadata service endpoint used for credentials.
+func NewSession(ec2MetadataEndpoint string) *session.Session {
+	if ec2MetadataEndpoint == "" {
+		return session.Must(session.NewSession())
+	}
+
+	resolver := func(service, region string, optFns ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+		if service == endpoints.Ec2metadataServiceID {
+			return endpoints.ResolvedEndpoint{
+				URL:           fmt.Sprintf("http://%s/latest", ec2MetadataEndpoint),
+				SigningName:   service,
+				SigningMethod: "v4",
+			}, nil
+		}
+
+		return endpoints.DefaultResolver().EndpointFor(service, region, optFns...)
+	}
+	return session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+		Config: aws.Config{
+			EndpointResolver: endpoints.ResolverFunc(resolver),
+		},
+	}))
+}
+
+// Region returns the configured aws region, falling back to the region reported by the metadata service.
+func Region() string {
+	sess := session.Must(session.NewSession())
+	if sess.Config.Region != nil && *sess.Config.Region != "" {
+		return *sess.Config.Region
+	}
+	meta := ec2metadata.New(sess)
+	if meta.Available() {
+		region, err := meta.Region()
+		if err == nil {
+			return region
+		}
+	}
+	return ""
+}
@@ -0,0 +1,267 @@
+// Package file provides a destination that writes records to a local file as newline delimited JSON.
+//
+// Files are rotated based on size and age, and a configurable number of rotated files are retained.
+// Each batch of records is fsync'd to disk before its cursor is published, so the cursor only advances
+// once the data is durable.
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/channel"
+	"github.com/wearefair/log-aggregator/pkg/logging"
+	"github.com/wearefair/log-aggregator/pkg/types"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultBufferFlushLimit = 500
+	DefaultFlushInterval    = time.Second * 1
+	DefaultMaxFileSize      = 100 * 1024 * 1024
+	DefaultMaxFileAge       = time.Hour * 24
+	DefaultRetention        = 10
+
+	// Suffix format of rotated files, sorts chronologically.
+	rotatedTimeFormat = "20060102T150405.000000000"
+)
+
+type Config struct {
+	// Path of the file that is written to. Rotated files are named <Path>.<timestamp>
+	Path string
+	// Gzip compresses the files. Every run appends a new gzip member to the file.
+	Gzip bool
+	// MaxFileSize is the size (on disk) at which the file is rotated.
+	MaxFileSize int64
+	// MaxFileAge is the time after which the file is rotated, regardless of its size.
+	MaxFileAge time.Duration
+	// Retention is the number of rotated files to keep.
+	Retention        int
+	BufferFlushLimit int
+	FlushInterval    time.Duration
+}
+
+type Client struct {
+	buffer           <-chan []*types.Record
+	progress         chan<- types.Cursor
+	path             string
+	gzip             bool
+	maxFileSize      int64
+	maxFileAge       time.Duration
+	retention        int
+	bufferFlushLimit int
+	flushInterval    time.Duration
+
+	// The currently open file
+	file     *os.File
+	writer   *bufio.Writer
+	gzipper  *gzip.Writer
+	size     int64
+	openedAt time.Time
+}
+
+func New(conf Config) *Client {
+	client := &Client{
+		path:             conf.Path,
+		gzip:             conf.Gzip,
+		maxFileSize:      conf.MaxFileSize,
+		maxFileAge:       conf.MaxFileAge,
+		retention:        conf.Retention,
+		bufferFlushLimit: conf.BufferFlushLimit,
+		flushInterval:    conf.FlushInterval,
+	}
+	if client.maxFileSize == 0 {
+		client.maxFileSize = DefaultMaxFileSize
+	}
+	if client.maxFileAge == time.Duration(0) {
+		client.maxFileAge = DefaultMaxFileAge
+	}
+	if client.retention == 0 {
+		client.retention = DefaultRetention
+	}
+	if client.bufferFlushLimit == 0 {
+		client.bufferFlushLimit = DefaultBufferFlushLimit
+	}
+	if client.flushInterval == time.Duration(0) {
+		client.flushInterval = DefaultFlushInterval
+	}
+	return client
+}
+
+func (c *Client) Start(records <-chan *types.Record, progress chan<- types.Cursor) {
+	if c.buffer != nil {
+		panic(errors.New("Tried to start file output a second time"))
+	}
+	c.buffer = channel.NewBufferedChannel(c.bufferFlushLimit, c.flushInterval, records)
+	c.progress = progress
+	go c.deliver()
+}
+
+func (c *Client) deliver() {
+	for {
+		records, ok := <-c.buffer
+		if !ok {
+			logging.Logger.Warn("record channel was unexpectedly closed")
+			c.close()
+			return
+		}
+
+		strategy := backoff.NewExponentialBackOff()
+		strategy.MaxElapsedTime = time.Minute * 15
+		err := backoff.Retry(func() error {
+			err := c.writeBatch(records)
+			if err != nil {
+				logging.Error(err)
+				// Reopen the file on the next attempt.
+				c.close()
+			}
+			return err
+		}, strategy)
+		if err != nil {
+			panic(errors.Wrap(err, "Got unrecoverable error writing to file"))
+		}
+		c.progress <- records[len(records)-1].Cursor
+
+		if c.size >= c.maxFileSize || time.Since(c.openedAt) >= c.maxFileAge {
+			if err := c.rotate(); err != nil {
+				logging.Error(err)
+			}
+		}
+	}
+}
+
+// writeBatch writes the records to the file, and syncs it to disk.
+func (c *Client) writeBatch(records []*types.Record) error {
+	if c.file == nil {
+		if err := c.open(); err != nil {
+			return err
+		}
+	}
+
+	var out io.Writer = c.writer
+	if c.gzipper != nil {
+		out = c.gzipper
+	}
+	for _, record := range records {
+		serialized, err := json.Marshal(record.Fields)
+		if err != nil {
+			logging.Error(errors.Wrap(err, "Failed to marshal record to json"))
+			continue
+		}
+		if _, err := out.Write(append(serialized, '\n')); err != nil {
+			return errors.Wrapf(err, "Error writing to %s", c.path)
+		}
+	}
+	return c.sync()
+}
+
+// sync flushes all buffers and fsyncs the file.
+func (c *Client) sync() error {
+	if c.gzipper != nil {
+		if err := c.gzipper.Flush(); err != nil {
+			return errors.Wrapf(err, "Error flushing gzip writer for %s", c.path)
+		}
+	}
+	if err := c.writer.Flush(); err != nil {
+		return errors.Wrapf(err, "Error flushing %s", c.path)
+	}
+	if err := c.file.Sync(); err != nil {
+		return errors.Wrapf(err, "Error syncing %s", c.path)
+	}
+	info, err := c.file.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "Error getting size of %s", c.path)
+	}
+	c.size = info.Size()
+	return nil
+}
+
+func (c *Client) open() error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return errors.Wrapf(err, "Error creating directory for %s", c.path)
+	}
+	file, err := os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Error opening %s", c.path)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "Error getting size of %s", c.path)
+	}
+
+	c.file = file
+	c.writer = bufio.NewWriter(file)
+	if c.gzip {
+		c.gzipper = gzip.NewWriter(c.writer)
+	}
+	c.size = info.Size()
+	c.openedAt = time.Now()
+	return nil
+}
+
+// close flushes and closes the file, ignoring errors.
+func (c *Client) close() {
+	if c.file == nil {
+		return
+	}
+	if c.gzipper != nil {
+		c.gzipper.Close()
+	}
+	c.writer.Flush()
+	c.file.Sync()
+	c.file.Close()
+	c.file = nil
+	c.writer = nil
+	c.gzipper = nil
+}
+
+// rotate renames the current file, and removes rotated files beyond the retention count.
+// The file is reopened on the next write.
+func (c *Client) rotate() error {
+	c.close()
+	rotated := fmt.Sprintf("%s.%s", c.path, time.Now().UTC().Format(rotatedTimeFormat))
+	if err := os.Rename(c.path, rotated); err != nil {
+		return errors.Wrapf(err, "Error rotating %s", c.path)
+	}
+	logging.Logger.Info("Rotated file", zap.String("path", rotated))
+
+	files, err := c.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	for len(files) > c.retention {
+		if err := os.Remove(files[0]); err != nil {
+			return errors.Wrapf(err, "Error removing rotated file %s", files[0])
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// rotatedFiles returns the rotated files, oldest first.
+func (c *Client) rotatedFiles() ([]string, error) {
+	matches, err := filepath.Glob(c.path + ".*")
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing rotated files")
+	}
+	files := make([]string, 0, len(matches))
+	for _, match := range matches {
+		suffix := strings.TrimPrefix(match, c.path+".")
+		if _, err := time.Parse(rotatedTimeFormat, suffix); err == nil {
+			files = append(files, match)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
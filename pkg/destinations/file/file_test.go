@@ -0,0 +1,127 @@
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+func TestWriteBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-destination")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := New(Config{Path: filepath.Join(dir, "records.json")})
+	err = client.writeBatch([]*types.Record{
+		{Cursor: types.Cursor("1"), Fields: map[string]interface{}{"log": "one"}},
+		{Cursor: types.Cursor("2"), Fields: map[string]interface{}{"log": "two"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Data has to be on disk without closing the file
+	contents, err := ioutil.ReadFile(client.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "{\"log\":\"one\"}\n{\"log\":\"two\"}\n"
+	if string(contents) != expected {
+		t.Errorf("Expected file to contain '%s', but got '%s'", expected, contents)
+	}
+	if client.size != int64(len(expected)) {
+		t.Errorf("Expected size to be %d, but got %d", len(expected), client.size)
+	}
+}
+
+func TestWriteBatchGzip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-destination")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := New(Config{Path: filepath.Join(dir, "records.json.gz"), Gzip: true})
+	for _, log := range []string{"one", "two"} {
+		err = client.writeBatch([]*types.Record{
+			{Fields: map[string]interface{}{"log": log}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Start a new gzip member, as if the process restarted.
+		client.close()
+	}
+
+	file, err := os.Open(client.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(reader)
+	lines := []string{}
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 2 || lines[0] != `{"log":"one"}` || lines[1] != `{"log":"two"}` {
+		t.Errorf("Expected both records to be readable, but got %v", lines)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file-destination")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := New(Config{Path: filepath.Join(dir, "records.json"), Retention: 2})
+	// Unrelated files are left alone
+	if err := ioutil.WriteFile(client.path+".backup", []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = client.writeBatch([]*types.Record{
+			{Fields: map[string]interface{}{"log": i}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := client.rotatedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected 2 rotated files to be retained, but got %d", len(files))
+	}
+	contents, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "{\"log\":1}\n" {
+		t.Errorf("Expected the oldest rotated file to be removed, but got '%s'", contents)
+	}
+	if _, err := os.Stat(client.path + ".backup"); err != nil {
+		t.Errorf("Expected unrelated file to be kept, but got %s", err)
+	}
+	if _, err := os.Stat(client.path); !os.IsNotExist(err) {
+		t.Errorf("Expected the active file to be reopened on the next write")
+	}
+}
@@ -8,12 +8,10 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/endpoints"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/firehose"
 	"github.com/cenkalti/backoff"
 	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/awsutil"
 	"github.com/wearefair/log-aggregator/pkg/channel"
 	"github.com/wearefair/log-aggregator/pkg/logging"
 	"github.com/wearefair/log-aggregator/pkg/types"
@@ -60,14 +58,8 @@ func New(conf Config) *Client {
 		interval = conf.FlushInterval
 	}
 
-	var sess *session.Session
-	if conf.EC2MetadataEndpoint != "" {
-		sess = awsSession(conf)
-	} else {
-		sess = session.Must(session.NewSession())
-	}
-
-	region := getRegion()
+	sess := awsutil.NewSession(conf.EC2MetadataEndpoint)
+	region := awsutil.Region()
 	logging.Logger.Info("Setting aws region", zap.String("region", region))
 	client := &Client{
 		firehoseClient:   firehose.New(sess, sess.Config.WithRegion(region)),
@@ -185,38 +177,3 @@ func recordsToBatches(records []*types.Record, maxRecords, maxRecordSize, maxBat
 	}
 	return batches
 }
-
-func awsSession(conf Config) *session.Session {
-	resolver := func(service, region string, optFns ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
-		if service == endpoints.Ec2metadataServiceID {
-			return endpoints.ResolvedEndpoint{
-				URL:           fmt.Sprintf("http://%s/latest", conf.EC2MetadataEndpoint),
-				SigningName:   service,
-				SigningMethod: "v4",
-			}, nil
-		}
-
-		return endpoints.DefaultResolver().EndpointFor(service, region, optFns...)
-	}
-	return session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-		Config: aws.Config{
-			EndpointResolver: endpoints.ResolverFunc(resolver),
-		},
-	}))
-}
-
-func getRegion() string {
-	sess := session.Must(session.NewSession())
-	if sess.Config.Region != nil && *sess.Config.Region != "" {
-		return *sess.Config.Region
-	}
-	meta := ec2metadata.New(sess)
-	if meta.Available() {
-		region, err := meta.Region()
-		if err == nil {
-			return region
-		}
-	}
-	return ""
-}
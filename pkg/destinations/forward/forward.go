@@ -0,0 +1,300 @@
+// Package forward provides a destination that sends records to Fluentd (or Fluent Bit) using the
+// Forward protocol.
+//
+// Records are sent in PackedForward mode (optionally gzip compressed), grouped by a tag derived from
+// the record fields. Each message carries a chunk id, and the cursor is only published once the server
+// has acknowledged every message of a batch.
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+	"github.com/wearefair/log-aggregator/pkg/channel"
+	"github.com/wearefair/log-aggregator/pkg/fluent"
+	"github.com/wearefair/log-aggregator/pkg/logging"
+	"github.com/wearefair/log-aggregator/pkg/template"
+	"github.com/wearefair/log-aggregator/pkg/types"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultTagTemplate      = "log-aggregator"
+	DefaultBufferFlushLimit = 500
+	DefaultFlushInterval    = time.Second * 1
+	DefaultTimeout          = time.Second * 30
+)
+
+type Config struct {
+	// Address of the server, host:port
+	Address string
+	// TLSConfig enables TLS when set
+	TLSConfig *tls.Config
+	// TagTemplate is rendered for each record (see the template package) to pick its tag.
+	TagTemplate string
+	// Compress sends messages in CompressedPackedForward mode.
+	Compress bool
+	// DisableAck publishes progress as soon as a message is written, instead of waiting for the
+	// server to acknowledge it. Use this for servers that don't support acks.
+	DisableAck bool
+	// Timeout for connecting, writing a message, and waiting for its ack.
+	Timeout          time.Duration
+	BufferFlushLimit int
+	FlushInterval    time.Duration
+}
+
+type Client struct {
+	buffer           <-chan []*types.Record
+	progress         chan<- types.Cursor
+	address          string
+	tlsConfig        *tls.Config
+	tagTemplate      *template.Template
+	compress         bool
+	requireAck       bool
+	timeout          time.Duration
+	bufferFlushLimit int
+	flushInterval    time.Duration
+	conn             net.Conn
+	reader           *bufio.Reader
+}
+
+// A message for a single tag.
+type message struct {
+	tag     string
+	records []*types.Record
+}
+
+func New(conf Config) (*Client, error) {
+	tagTemplate := DefaultTagTemplate
+	if conf.TagTemplate != "" {
+		tagTemplate = conf.TagTemplate
+	}
+	compiled, err := template.New(tagTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := DefaultTimeout
+	if conf.Timeout != time.Duration(0) {
+		timeout = conf.Timeout
+	}
+
+	limit := DefaultBufferFlushLimit
+	if conf.BufferFlushLimit != 0 {
+		limit = conf.BufferFlushLimit
+	}
+
+	interval := DefaultFlushInterval
+	if conf.FlushInterval != time.Duration(0) {
+		interval = conf.FlushInterval
+	}
+
+	return &Client{
+		address:          conf.Address,
+		tlsConfig:        conf.TLSConfig,
+		tagTemplate:      compiled,
+		compress:         conf.Compress,
+		requireAck:       !conf.DisableAck,
+		timeout:          timeout,
+		bufferFlushLimit: limit,
+		flushInterval:    interval,
+	}, nil
+}
+
+func (c *Client) Start(records <-chan *types.Record, progress chan<- types.Cursor) {
+	if c.buffer != nil {
+		panic(errors.New("Tried to start forward output a second time"))
+	}
+	c.buffer = channel.NewBufferedChannel(c.bufferFlushLimit, c.flushInterval, records)
+	c.progress = progress
+	go c.deliver()
+}
+
+func (c *Client) deliver() {
+	for {
+		records, ok := <-c.buffer
+		if !ok {
+			logging.Logger.Warn("record channel was unexpectedly closed")
+			c.close()
+			return
+		}
+
+		for _, msg := range c.groupByTag(records) {
+			strategy := backoff.NewExponentialBackOff()
+			strategy.MaxElapsedTime = time.Hour * 1
+			err := backoff.Retry(func() error {
+				err := c.send(msg)
+				if err != nil {
+					logging.Logger.Error(fmt.Sprintf("failed to forward message: %s", err),
+						zap.String("address", c.address), zap.String("tag", msg.tag))
+					// Reconnect on the next attempt.
+					c.close()
+				}
+				return err
+			}, strategy)
+			if err != nil {
+				panic(errors.Wrap(err, "Got unrecoverable error forwarding records"))
+			}
+		}
+		c.progress <- records[len(records)-1].Cursor
+	}
+}
+
+// groupByTag splits a batch of records into one message per tag, in the order the tags first appear.
+func (c *Client) groupByTag(records []*types.Record) []*message {
+	messages := []*message{}
+	byTag := make(map[string]*message)
+	for _, record := range records {
+		tag, err := c.tagTemplate.Execute(record)
+		if err != nil || tag == "" {
+			if err != nil {
+				logging.Error(err)
+			}
+			tag = DefaultTagTemplate
+		}
+		msg, ok := byTag[tag]
+		if !ok {
+			msg = &message{tag: tag}
+			byTag[tag] = msg
+			messages = append(messages, msg)
+		}
+		msg.records = append(msg.records, record)
+	}
+	return messages
+}
+
+// send writes a message and waits for it to be acknowledged.
+func (c *Client) send(msg *message) error {
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return err
+		}
+	}
+
+	chunk := ""
+	if c.requireAck {
+		chunk = newChunkID()
+	}
+	encoded, err := c.encode(msg, chunk)
+	if err != nil {
+		return err
+	}
+
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(encoded); err != nil {
+		return errors.Wrap(err, "Error writing message")
+	}
+
+	if c.requireAck {
+		var ack fluent.Ack
+		if err := msgpack.NewDecoder(c.reader).Decode(&ack); err != nil {
+			return errors.Wrap(err, "Error reading ack")
+		}
+		if ack.Ack != chunk {
+			return errors.Errorf("Expected ack for chunk %s, but got %s", chunk, ack.Ack)
+		}
+	}
+	return nil
+}
+
+// encode serializes a message in (Compressed)PackedForward mode: [tag, entries, option]
+func (c *Client) encode(msg *message, chunk string) ([]byte, error) {
+	var entries bytes.Buffer
+	var out io.Writer = &entries
+	var gzipper *gzip.Writer
+	if c.compress {
+		gzipper = gzip.NewWriter(&entries)
+		out = gzipper
+	}
+
+	// Entries are encoded on their own first, so that a record that fails halfway doesn't leave
+	// partial bytes in the payload.
+	var entry bytes.Buffer
+	entryEncoder := msgpack.NewEncoder(&entry).UseJSONTag(true)
+	size := 0
+	for _, record := range msg.records {
+		recordTime := record.Time
+		if recordTime.IsZero() {
+			recordTime = time.Now()
+		}
+		entry.Reset()
+		err := entryEncoder.Encode([]interface{}{&fluent.EventTime{Time: recordTime}, record.Fields})
+		if err != nil {
+			logging.Error(errors.Wrap(err, "Failed to marshal record to msgpack"))
+			continue
+		}
+		if _, err := out.Write(entry.Bytes()); err != nil {
+			return nil, errors.Wrap(err, "Error compressing entries")
+		}
+		size++
+	}
+
+	option := fluent.Option{
+		Size:  size,
+		Chunk: chunk,
+	}
+	if gzipper != nil {
+		if err := gzipper.Close(); err != nil {
+			return nil, errors.Wrap(err, "Error compressing entries")
+		}
+		option.Compressed = fluent.CompressionGzip
+	}
+
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	if err := encoder.EncodeArrayLen(3); err != nil {
+		return nil, err
+	}
+	if err := encoder.EncodeString(msg.tag); err != nil {
+		return nil, err
+	}
+	if err := encoder.EncodeBytes(entries.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := encoder.Encode(&option); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *Client) connect() error {
+	dialer := &net.Dialer{Timeout: c.timeout}
+	var conn net.Conn
+	var err error
+	if c.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.address, c.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", c.address)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Error connecting to %s", c.address)
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	return nil
+}
+
+func (c *Client) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.reader = nil
+	}
+}
+
+func newChunkID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return base64.StdEncoding.EncodeToString(id)
+}
@@ -0,0 +1,175 @@
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+	"github.com/wearefair/log-aggregator/pkg/fluent"
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+type receivedMessage struct {
+	tag     string
+	entries [][]interface{}
+	option  fluent.Option
+}
+
+// Reads a single PackedForward message, and acks it.
+func receive(conn net.Conn) (*receivedMessage, error) {
+	decoder := msgpack.NewDecoder(conn)
+	if _, err := decoder.DecodeArrayLen(); err != nil {
+		return nil, err
+	}
+	msg := &receivedMessage{}
+	var err error
+	if msg.tag, err = decoder.DecodeString(); err != nil {
+		return nil, err
+	}
+	packed, err := decoder.DecodeBytes()
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(&msg.option); err != nil {
+		return nil, err
+	}
+
+	if msg.option.Compressed == fluent.CompressionGzip {
+		reader, err := gzip.NewReader(bytes.NewReader(packed))
+		if err != nil {
+			return nil, err
+		}
+		if packed, err = ioutil.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+	entries := msgpack.NewDecoder(bytes.NewReader(packed))
+	for i := 0; i < msg.option.Size; i++ {
+		entry, err := entries.DecodeSlice()
+		if err != nil {
+			return nil, err
+		}
+		msg.entries = append(msg.entries, entry)
+	}
+
+	ack, err := msgpack.Marshal(&fluent.Ack{Ack: msg.option.Chunk})
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(ack)
+	return msg, err
+}
+
+func TestSend(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan *receivedMessage, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msg, err := receive(conn)
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+
+	client, err := New(Config{
+		Address:     listener.Addr().String(),
+		TagTemplate: `k8s.{{.Field "namespace" | default "none"}}`,
+		Compress:    true,
+		Timeout:     time.Second * 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.close()
+
+	recordTime := time.Unix(1487349663, 588456153)
+	messages := client.groupByTag([]*types.Record{
+		{Time: recordTime, Fields: map[string]interface{}{"namespace": "default", "log": "one"}},
+		{Time: recordTime, Fields: map[string]interface{}{"log": "two"}},
+		{Time: recordTime, Fields: map[string]interface{}{"namespace": "default", "log": "three"}},
+	})
+	if len(messages) != 2 {
+		t.Fatalf("Expected records to be grouped into 2 messages, but got %d", len(messages))
+	}
+
+	for _, msg := range messages {
+		if err := client.send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg := <-received
+	if msg.tag != "k8s.default" {
+		t.Errorf("Expected tag to be k8s.default, but got %s", msg.tag)
+	}
+	if msg.option.Chunk == "" {
+		t.Errorf("Expected a chunk id to be set")
+	}
+	if len(msg.entries) != 2 {
+		t.Fatalf("Expected 2 entries, but got %d", len(msg.entries))
+	}
+	if eventTime, ok := msg.entries[0][0].(*fluent.EventTime); !ok || !eventTime.Equal(recordTime) {
+		t.Errorf("Expected entry time to be %s, but got %v", recordTime, msg.entries[0][0])
+	}
+	if fields, ok := msg.entries[1][1].(map[string]interface{}); !ok || fields["log"] != "three" {
+		t.Errorf("Expected second entry to be record three, but got %v", msg.entries[1][1])
+	}
+
+	msg = <-received
+	if msg.tag != "k8s.none" || len(msg.entries) != 1 {
+		t.Errorf("Expected 1 entry with tag k8s.none, but got %d with tag %s", len(msg.entries), msg.tag)
+	}
+}
+
+func TestEncodeSkipsInvalidRecords(t *testing.T) {
+	client := &Client{}
+	encoded, err := client.encode(&message{tag: "test", records: []*types.Record{
+		{Fields: map[string]interface{}{"log": "one"}},
+		{Fields: map[string]interface{}{"log": "two", "invalid": make(chan int)}},
+		{Fields: map[string]interface{}{"log": "three"}},
+	}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := msgpack.NewDecoder(bytes.NewReader(encoded))
+	decoder.DecodeArrayLen()
+	decoder.DecodeString()
+	packed, err := decoder.DecodeBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var option fluent.Option
+	if err := decoder.Decode(&option); err != nil {
+		t.Fatal(err)
+	}
+	if option.Size != 2 {
+		t.Fatalf("Expected 2 entries, but got %d", option.Size)
+	}
+	entries := msgpack.NewDecoder(bytes.NewReader(packed))
+	for _, expected := range []string{"one", "three"} {
+		entry, err := entries.DecodeSlice()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fields, ok := entry[1].(map[string]interface{}); !ok || fields["log"] != expected {
+			t.Errorf("Expected record %s, but got %v", expected, entry[1])
+		}
+	}
+}
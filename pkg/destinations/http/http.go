@@ -0,0 +1,261 @@
+// Package http provides a destination that POSTs batches of records to an HTTP endpoint.
+//
+// Batches are encoded as newline delimited JSON, or as a JSON array, and can optionally be gzip'd.
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/channel"
+	"github.com/wearefair/log-aggregator/pkg/logging"
+	"github.com/wearefair/log-aggregator/pkg/types"
+	"go.uber.org/zap"
+)
+
+const (
+	FormatNDJSON = "ndjson"
+	FormatJSON   = "json"
+
+	DefaultBufferFlushLimit = 500
+	DefaultFlushInterval    = time.Second * 1
+	DefaultTimeout          = time.Second * 30
+	DefaultMethod           = http.MethodPost
+	DefaultFormat           = FormatNDJSON
+)
+
+// DefaultRetryableStatusCodes are the response codes for which a batch is retried.
+// Any other non 2xx response drops the batch.
+var DefaultRetryableStatusCodes = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+type Config struct {
+	URL    string
+	Method string
+	// Format is either ndjson (newline delimited JSON), or json (a JSON array of records).
+	Format  string
+	Headers map[string]string
+	// Username and Password enable basic auth
+	Username string
+	Password string
+	// BearerToken is sent in the Authorization header
+	BearerToken          string
+	Gzip                 bool
+	RetryableStatusCodes []int
+	Timeout              time.Duration
+	BufferFlushLimit     int
+	FlushInterval        time.Duration
+}
+
+type Client struct {
+	buffer           <-chan []*types.Record
+	progress         chan<- types.Cursor
+	httpClient       *http.Client
+	url              string
+	method           string
+	format           string
+	headers          map[string]string
+	username         string
+	password         string
+	bearerToken      string
+	gzip             bool
+	retryable        map[int]bool
+	bufferFlushLimit int
+	flushInterval    time.Duration
+}
+
+func New(conf Config) (*Client, error) {
+	if conf.URL == "" {
+		return nil, errors.New("HTTP destination requires a URL")
+	}
+
+	format := DefaultFormat
+	if conf.Format != "" {
+		format = conf.Format
+	}
+	if format != FormatNDJSON && format != FormatJSON {
+		return nil, errors.Errorf("Unknown HTTP destination format %s", format)
+	}
+
+	method := DefaultMethod
+	if conf.Method != "" {
+		method = conf.Method
+	}
+
+	timeout := DefaultTimeout
+	if conf.Timeout != time.Duration(0) {
+		timeout = conf.Timeout
+	}
+
+	limit := DefaultBufferFlushLimit
+	if conf.BufferFlushLimit != 0 {
+		limit = conf.BufferFlushLimit
+	}
+
+	interval := DefaultFlushInterval
+	if conf.FlushInterval != time.Duration(0) {
+		interval = conf.FlushInterval
+	}
+
+	statusCodes := DefaultRetryableStatusCodes
+	if len(conf.RetryableStatusCodes) != 0 {
+		statusCodes = conf.RetryableStatusCodes
+	}
+	retryable := make(map[int]bool)
+	for _, code := range statusCodes {
+		retryable[code] = true
+	}
+
+	return &Client{
+		httpClient:       &http.Client{Timeout: timeout},
+		url:              conf.URL,
+		method:           method,
+		format:           format,
+		headers:          conf.Headers,
+		username:         conf.Username,
+		password:         conf.Password,
+		bearerToken:      conf.BearerToken,
+		gzip:             conf.Gzip,
+		retryable:        retryable,
+		bufferFlushLimit: limit,
+		flushInterval:    interval,
+	}, nil
+}
+
+func (c *Client) Start(records <-chan *types.Record, progress chan<- types.Cursor) {
+	if c.buffer != nil {
+		panic(errors.New("Tried to start http output a second time"))
+	}
+	c.buffer = channel.NewBufferedChannel(c.bufferFlushLimit, c.flushInterval, records)
+	c.progress = progress
+	go c.deliver()
+}
+
+func (c *Client) deliver() {
+	for {
+		records, ok := <-c.buffer
+		if !ok {
+			logging.Logger.Warn("record channel was unexpectedly closed")
+			return
+		}
+
+		body, err := c.encode(records)
+		if err != nil {
+			panic(errors.Wrap(err, "Error encoding batch"))
+		}
+
+		strategy := backoff.NewExponentialBackOff()
+		strategy.MaxElapsedTime = time.Hour * 1
+		err = backoff.Retry(func() error {
+			retry, err := c.send(body)
+			if err == nil {
+				return nil
+			}
+			logging.Logger.Error(fmt.Sprintf("failed to post batch: %s", err), zap.String("url", c.url))
+			if !retry {
+				// The endpoint rejected the batch, retrying won't help.
+				return nil
+			}
+			return err
+		}, strategy)
+		if err != nil {
+			panic(errors.Wrap(err, "Got unrecoverable error posting to http endpoint"))
+		}
+		c.progress <- records[len(records)-1].Cursor
+	}
+}
+
+// encode serializes a batch of records into a request body.
+func (c *Client) encode(records []*types.Record) ([]byte, error) {
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+	var gzipper *gzip.Writer
+	if c.gzip {
+		gzipper = gzip.NewWriter(&buf)
+		out = gzipper
+	}
+
+	first := true
+	if c.format == FormatJSON {
+		out.Write([]byte("["))
+	}
+	for _, record := range records {
+		serialized, err := json.Marshal(record.Fields)
+		if err != nil {
+			logging.Error(errors.Wrap(err, "Failed to marshal record to json"))
+			continue
+		}
+		if c.format == FormatJSON {
+			if !first {
+				out.Write([]byte(","))
+			}
+		} else {
+			serialized = append(serialized, '\n')
+		}
+		out.Write(serialized)
+		first = false
+	}
+	if c.format == FormatJSON {
+		out.Write([]byte("]"))
+	}
+
+	if gzipper != nil {
+		if err := gzipper.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// send makes a single request, and returns whether it should be retried if it failed.
+func (c *Client) send(body []byte) (bool, error) {
+	req, err := http.NewRequest(c.method, c.url, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "Error constructing request")
+	}
+
+	if c.format == FormatJSON {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	if c.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if c.username != "" || c.password != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	if c.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.bearerToken)
+	}
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "Error sending request")
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused.
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	return c.retryable[resp.StatusCode], errors.Errorf("Got response status %s", resp.Status)
+}
@@ -0,0 +1,111 @@
+package http
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+var testRecords = []*types.Record{
+	{Cursor: types.Cursor("1"), Fields: map[string]interface{}{"log": "one"}},
+	{Cursor: types.Cursor("2"), Fields: map[string]interface{}{"log": "two"}},
+}
+
+func TestEncode(t *testing.T) {
+	client, err := New(Config{URL: "http://localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := client.encode(testRecords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{\"log\":\"one\"}\n{\"log\":\"two\"}\n"; string(body) != expected {
+		t.Errorf("Expected ndjson body '%s', but got '%s'", expected, body)
+	}
+
+	client, err = New(Config{URL: "http://localhost", Format: FormatJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = client.encode(testRecords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `[{"log":"one"},{"log":"two"}]`; string(body) != expected {
+		t.Errorf("Expected json body '%s', but got '%s'", expected, body)
+	}
+
+	if _, err := New(Config{URL: "http://localhost", Format: "xml"}); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
+
+func TestSend(t *testing.T) {
+	var status int
+	var body string
+	var req *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		bodyBytes, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		body = string(bodyBytes)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	client, err := New(Config{
+		URL:         server.URL,
+		Gzip:        true,
+		BearerToken: "mytoken",
+		Headers: map[string]string{
+			"X-Source": "log-aggregator",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := client.encode(testRecords)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status = http.StatusOK
+	if _, err := client.send(encoded); err != nil {
+		t.Fatalf("Expected request to succeed, but got %s", err)
+	}
+	if expected := "{\"log\":\"one\"}\n{\"log\":\"two\"}\n"; body != expected {
+		t.Errorf("Expected body '%s', but got '%s'", expected, body)
+	}
+	if val := req.Header.Get("Authorization"); val != "Bearer mytoken" {
+		t.Errorf("Expected Authorization header to be 'Bearer mytoken', but got '%s'", val)
+	}
+	if val := req.Header.Get("X-Source"); val != "log-aggregator" {
+		t.Errorf("Expected X-Source header to be 'log-aggregator', but got '%s'", val)
+	}
+	if val := req.Header.Get("Content-Encoding"); val != "gzip" {
+		t.Errorf("Expected Content-Encoding header to be 'gzip', but got '%s'", val)
+	}
+
+	status = http.StatusServiceUnavailable
+	if retry, err := client.send(encoded); err == nil || !retry {
+		t.Errorf("Expected a retryable error for status %d, but got %t %v", status, retry, err)
+	}
+
+	status = http.StatusBadRequest
+	if retry, err := client.send(encoded); err == nil || retry {
+		t.Errorf("Expected a non retryable error for status %d, but got %t %v", status, retry, err)
+	}
+}
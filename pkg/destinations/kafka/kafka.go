@@ -0,0 +1,328 @@
+// Package kafka provides a destination that publishes records to Kafka topics.
+//
+// It uses an idempotent producer that waits for all in-sync replicas to acknowledge each message,
+// and only publishes a cursor once every record up to it has been delivered.
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/logging"
+	"github.com/wearefair/log-aggregator/pkg/template"
+	"github.com/wearefair/log-aggregator/pkg/types"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultTopicTemplate = "logs"
+	DefaultCompression   = "snappy"
+	DefaultVersion       = "1.0.0"
+	DefaultClientID      = "log-aggregator"
+
+	// How long to keep re-publishing a message that the producer failed to deliver, before giving up.
+	maxRetryTime = time.Hour * 1
+)
+
+type Config struct {
+	Brokers []string
+	// TopicTemplate is rendered for each record (see the template package) to pick the topic
+	// it is published to.
+	TopicTemplate string
+	// KeyField is the (nested) record field used as the message key, e.g. kubernetes.pod_name.
+	// Records without the field are published without a key.
+	KeyField string
+	// Compression is one of none, gzip, snappy, lz4 or zstd.
+	Compression string
+	// Version is the Kafka version of the brokers, and must be at least 0.11.0 for the idempotent producer.
+	Version  string
+	ClientID string
+}
+
+type Client struct {
+	producer      sarama.AsyncProducer
+	topicTemplate *template.Template
+	keyField      string
+	tracker       *tracker
+	progress      chan<- types.Cursor
+	started       bool
+	// Serializes acks, so progress is published in order.
+	ackLock sync.Mutex
+	// Closed once the producer is shutting down, which stops retries.
+	closing chan struct{}
+	// Guards sending retries to the producer input against it being closed.
+	closeLock sync.RWMutex
+}
+
+// delivery is the metadata of a producer message.
+type delivery struct {
+	seq uint64
+	// Set once the message failed to be delivered.
+	retries *backoff.ExponentialBackOff
+}
+
+func New(conf Config) (*Client, error) {
+	saramaConf, err := newSaramaConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	topicTemplate := DefaultTopicTemplate
+	if conf.TopicTemplate != "" {
+		topicTemplate = conf.TopicTemplate
+	}
+	compiled, err := template.New(topicTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	producer, err := sarama.NewAsyncProducer(conf.Brokers, saramaConf)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error constructing kafka producer")
+	}
+
+	return &Client{
+		producer:      producer,
+		topicTemplate: compiled,
+		keyField:      conf.KeyField,
+		tracker:       &tracker{},
+		closing:       make(chan struct{}),
+	}, nil
+}
+
+func newSaramaConfig(conf Config) (*sarama.Config, error) {
+	version := DefaultVersion
+	if conf.Version != "" {
+		version = conf.Version
+	}
+	kafkaVersion, err := sarama.ParseKafkaVersion(version)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing kafka version %s", version)
+	}
+
+	compression := DefaultCompression
+	if conf.Compression != "" {
+		compression = conf.Compression
+	}
+	codec, err := parseCompression(compression)
+	if err != nil {
+		return nil, err
+	}
+
+	clientID := DefaultClientID
+	if conf.ClientID != "" {
+		clientID = conf.ClientID
+	}
+
+	saramaConf := sarama.NewConfig()
+	saramaConf.ClientID = clientID
+	saramaConf.Version = kafkaVersion
+	saramaConf.Producer.Idempotent = true
+	saramaConf.Producer.RequiredAcks = sarama.WaitForAll
+	saramaConf.Producer.Compression = codec
+	saramaConf.Producer.Return.Successes = true
+	saramaConf.Producer.Return.Errors = true
+	saramaConf.Producer.Retry.Max = 10
+	// Required by the idempotent producer to guarantee ordering.
+	saramaConf.Net.MaxOpenRequests = 1
+
+	if err := saramaConf.Validate(); err != nil {
+		return nil, errors.Wrap(err, "Invalid kafka producer configuration")
+	}
+	return saramaConf, nil
+}
+
+func parseCompression(compression string) (sarama.CompressionCodec, error) {
+	switch strings.ToLower(compression) {
+	case "none":
+		return sarama.CompressionNone, nil
+	case "gzip":
+		return sarama.CompressionGZIP, nil
+	case "snappy":
+		return sarama.CompressionSnappy, nil
+	case "lz4":
+		return sarama.CompressionLZ4, nil
+	case "zstd":
+		return sarama.CompressionZSTD, nil
+	}
+	return sarama.CompressionNone, errors.Errorf("Unknown kafka compression codec %s", compression)
+}
+
+func (c *Client) Start(records <-chan *types.Record, progress chan<- types.Cursor) {
+	if c.started {
+		panic(errors.New("Tried to start kafka output a second time"))
+	}
+	c.started = true
+	c.progress = progress
+	go c.acknowledge()
+	go c.retry()
+	go c.publish(records)
+}
+
+func (c *Client) publish(records <-chan *types.Record) {
+	for {
+		record, ok := <-records
+		if !ok {
+			logging.Logger.Warn("record channel was unexpectedly closed")
+			c.closeLock.Lock()
+			close(c.closing)
+			c.producer.AsyncClose()
+			c.closeLock.Unlock()
+			return
+		}
+
+		seq := c.tracker.add(record.Cursor)
+		msg, err := c.newMessage(record)
+		if err != nil {
+			logging.Error(err)
+			// The record can never be published, so don't hold up the cursor.
+			c.ack(seq)
+			continue
+		}
+		msg.Metadata = &delivery{seq: seq}
+		c.producer.Input() <- msg
+	}
+}
+
+// newMessage converts a record to a producer message.
+func (c *Client) newMessage(record *types.Record) (*sarama.ProducerMessage, error) {
+	value, err := json.Marshal(record.Fields)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal record to json")
+	}
+
+	topic, err := c.topicTemplate.Execute(record)
+	if err != nil {
+		return nil, err
+	}
+	if topic == "" {
+		return nil, errors.Errorf("Topic template %s rendered an empty topic", c.topicTemplate)
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic:     topic,
+		Value:     sarama.ByteEncoder(value),
+		Timestamp: record.Time,
+	}
+	if c.keyField != "" {
+		if key, ok := record.LookupString(c.keyField); ok {
+			msg.Key = sarama.StringEncoder(key)
+		}
+	}
+	return msg, nil
+}
+
+// acknowledge reads delivery reports from the producer, and publishes progress.
+func (c *Client) acknowledge() {
+	for msg := range c.producer.Successes() {
+		c.ack(msg.Metadata.(*delivery).seq)
+	}
+}
+
+// retry drains the messages that the producer failed to deliver after its own retries are exhausted,
+// and schedules each one to be re-published after its own exponential backoff. The process panics
+// once a message couldn't be delivered for maxRetryTime.
+func (c *Client) retry() {
+	for producerErr := range c.producer.Errors() {
+		logging.Logger.Error(fmt.Sprintf("failed to publish message to kafka: %s", producerErr.Err),
+			zap.String("topic", producerErr.Msg.Topic))
+
+		metadata := producerErr.Msg.Metadata.(*delivery)
+		if metadata.retries == nil {
+			metadata.retries = backoff.NewExponentialBackOff()
+			metadata.retries.MaxElapsedTime = maxRetryTime
+		}
+		wait := metadata.retries.NextBackOff()
+		if wait == backoff.Stop {
+			panic(errors.Wrap(producerErr.Err, "Got unrecoverable error publishing to kafka"))
+		}
+
+		// Copy the message, so that no producer state from the failed attempt is carried over.
+		msg := &sarama.ProducerMessage{
+			Topic:     producerErr.Msg.Topic,
+			Key:       producerErr.Msg.Key,
+			Value:     producerErr.Msg.Value,
+			Timestamp: producerErr.Msg.Timestamp,
+			Metadata:  metadata,
+		}
+		// Sending blocks while the producer is backed up, which must not stop errors from being drained.
+		time.AfterFunc(wait, func() {
+			c.resend(msg)
+		})
+	}
+}
+
+// resend re-publishes a message, unless the producer is shutting down.
+func (c *Client) resend(msg *sarama.ProducerMessage) {
+	c.closeLock.RLock()
+	defer c.closeLock.RUnlock()
+	select {
+	case <-c.closing:
+	default:
+		c.producer.Input() <- msg
+	}
+}
+
+func (c *Client) ack(seq uint64) {
+	c.ackLock.Lock()
+	defer c.ackLock.Unlock()
+	if cursor, ok := c.tracker.ack(seq); ok {
+		c.progress <- cursor
+	}
+}
+
+// tracker keeps track of the cursors of in-flight records, so that progress is only published once
+// a record and every record before it has been delivered.
+// Delivery reports for different partitions can arrive out of order.
+type tracker struct {
+	sync.Mutex
+	seq     uint64
+	pending []pendingCursor
+}
+
+type pendingCursor struct {
+	seq    uint64
+	cursor types.Cursor
+	acked  bool
+}
+
+// add registers an in-flight record, and returns its sequence number.
+func (t *tracker) add(cursor types.Cursor) uint64 {
+	t.Lock()
+	defer t.Unlock()
+	t.seq++
+	t.pending = append(t.pending, pendingCursor{seq: t.seq, cursor: cursor})
+	return t.seq
+}
+
+// ack marks a record as delivered, and returns the newest cursor that can be committed (if any).
+func (t *tracker) ack(seq uint64) (types.Cursor, bool) {
+	t.Lock()
+	defer t.Unlock()
+	if len(t.pending) == 0 || seq < t.pending[0].seq {
+		return "", false
+	}
+	index := int(seq - t.pending[0].seq)
+	if index >= len(t.pending) {
+		return "", false
+	}
+	t.pending[index].acked = true
+
+	var cursor types.Cursor
+	count := 0
+	for count < len(t.pending) && t.pending[count].acked {
+		cursor = t.pending[count].cursor
+		count++
+	}
+	if count == 0 {
+		return "", false
+	}
+	t.pending = t.pending[count:]
+	return cursor, true
+}
@@ -0,0 +1,155 @@
+package kafka
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/template"
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+func TestTracker(t *testing.T) {
+	track := &tracker{}
+	seq1 := track.add(types.Cursor("1"))
+	seq2 := track.add(types.Cursor("2"))
+	seq3 := track.add(types.Cursor("3"))
+
+	// Acking out of order doesn't commit anything
+	if cursor, ok := track.ack(seq2); ok {
+		t.Errorf("Expected no cursor to be committed, but got %s", cursor)
+	}
+
+	// Acking the first record commits everything that has been acked after it
+	if cursor, ok := track.ack(seq1); !ok || cursor != types.Cursor("2") {
+		t.Errorf("Expected cursor 2 to be committed, but got %s", cursor)
+	}
+
+	if cursor, ok := track.ack(seq3); !ok || cursor != types.Cursor("3") {
+		t.Errorf("Expected cursor 3 to be committed, but got %s", cursor)
+	}
+
+	// Duplicate acks are ignored
+	if cursor, ok := track.ack(seq3); ok {
+		t.Errorf("Expected duplicate ack to be ignored, but got %s", cursor)
+	}
+	if len(track.pending) != 0 {
+		t.Errorf("Expected no pending cursors, but got %d", len(track.pending))
+	}
+}
+
+func TestNewMessage(t *testing.T) {
+	client := &Client{
+		topicTemplate: template.Must(`logs-{{.Field "kubernetes.namespace_name" | default "none"}}`),
+		keyField:      "kubernetes.pod_name",
+	}
+	recordTime := time.Unix(1487349663, 0)
+
+	msg, err := client.newMessage(&types.Record{
+		Time: recordTime,
+		Fields: map[string]interface{}{
+			"log": "my log",
+			"kubernetes": map[string]interface{}{
+				"namespace_name": "default",
+				"pod_name":       "my-pod",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Topic != "logs-default" {
+		t.Errorf("Expected topic to be logs-default, but got %s", msg.Topic)
+	}
+	if msg.Key != sarama.StringEncoder("my-pod") {
+		t.Errorf("Expected key to be my-pod, but got %v", msg.Key)
+	}
+	if !msg.Timestamp.Equal(recordTime) {
+		t.Errorf("Expected timestamp to be %s, but got %s", recordTime, msg.Timestamp)
+	}
+	expectedValue := `{"kubernetes":{"namespace_name":"default","pod_name":"my-pod"},"log":"my log"}`
+	if value := string(msg.Value.(sarama.ByteEncoder)); value != expectedValue {
+		t.Errorf("Expected value to be %s, but got %s", expectedValue, value)
+	}
+
+	// Records without the key field don't get a key
+	msg, err = client.newMessage(&types.Record{
+		Fields: map[string]interface{}{
+			"log": "my log",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Topic != "logs-none" {
+		t.Errorf("Expected topic to be logs-none, but got %s", msg.Topic)
+	}
+	if msg.Key != nil {
+		t.Errorf("Expected no key, but got %v", msg.Key)
+	}
+}
+
+func TestNewSaramaConfig(t *testing.T) {
+	conf, err := newSaramaConfig(Config{Compression: "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conf.Producer.Idempotent || conf.Producer.RequiredAcks != sarama.WaitForAll {
+		t.Errorf("Expected an idempotent producer with acks=all")
+	}
+	if conf.Producer.Compression != sarama.CompressionGZIP {
+		t.Errorf("Expected gzip compression, but got %s", conf.Producer.Compression)
+	}
+
+	if _, err := newSaramaConfig(Config{Compression: "brotli"}); err == nil {
+		t.Errorf("Expected an error for an unknown compression codec")
+	}
+	if _, err := newSaramaConfig(Config{Version: "0.10.0"}); err == nil {
+		t.Errorf("Expected an error for a version that doesn't support the idempotent producer")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	conf := sarama.NewConfig()
+	conf.Producer.Return.Successes = true
+	// More messages fail than the producer can buffer errors for.
+	conf.ChannelBufferSize = 2
+	messages := conf.ChannelBufferSize * 3
+	producer := mocks.NewAsyncProducer(t, conf)
+	for i := 0; i < messages; i++ {
+		producer.ExpectInputAndFail(errors.New("broker unavailable"))
+	}
+	for i := 0; i < messages; i++ {
+		producer.ExpectInputAndSucceed()
+	}
+	client := &Client{
+		producer:      producer,
+		topicTemplate: template.Must(DefaultTopicTemplate),
+		tracker:       &tracker{},
+		closing:       make(chan struct{}),
+	}
+
+	records := make(chan *types.Record)
+	progress := make(chan types.Cursor, messages)
+	client.Start(records, progress)
+	for i := 1; i <= messages; i++ {
+		records <- &types.Record{Cursor: types.Cursor(strconv.Itoa(i)), Fields: map[string]interface{}{"log": "my log"}}
+	}
+
+	last := types.Cursor(strconv.Itoa(messages))
+	timeout := time.After(time.Second * 10)
+	for {
+		select {
+		case cursor := <-progress:
+			if cursor == last {
+				close(records)
+				return
+			}
+		case <-timeout:
+			t.Fatal("Expected the failed messages to be retried")
+		}
+	}
+}
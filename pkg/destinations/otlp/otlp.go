@@ -0,0 +1,523 @@
+// Package otlp provides a destination that exports records as OpenTelemetry log records, over
+// OTLP/HTTP (protobuf encoded) or OTLP/gRPC.
+//
+// The log field becomes the body of the log record, and the journald PRIORITY field (or the severity
+// decoded from it by the journal source) its severity.
+// The aws, kubernetes and docker enrichment objects are mapped to resource attributes using the
+// OpenTelemetry semantic conventions, and every other field becomes a log record attribute.
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/channel"
+	"github.com/wearefair/log-aggregator/pkg/logging"
+	"github.com/wearefair/log-aggregator/pkg/types"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcgzip "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ProtocolHTTP = "http"
+	ProtocolGRPC = "grpc"
+
+	DefaultProtocol         = ProtocolHTTP
+	DefaultHTTPEndpoint     = "http://localhost:4318/v1/logs"
+	DefaultGRPCEndpoint     = "localhost:4317"
+	DefaultBufferFlushLimit = 500
+	DefaultFlushInterval    = time.Second * 1
+	DefaultTimeout          = time.Second * 30
+
+	scopeName = "github.com/wearefair/log-aggregator"
+)
+
+type Config struct {
+	// Protocol is either http (OTLP/HTTP with protobuf payloads) or grpc.
+	Protocol string
+	// Endpoint is the full URL for http, e.g. http://collector:4318/v1/logs, and host:port for grpc.
+	Endpoint string
+	// Insecure disables TLS for grpc. For http, the scheme of the endpoint decides.
+	Insecure bool
+	// TLSConfig is used for grpc, and for https endpoints.
+	TLSConfig        *tls.Config
+	Headers          map[string]string
+	Gzip             bool
+	Timeout          time.Duration
+	BufferFlushLimit int
+	FlushInterval    time.Duration
+}
+
+type Client struct {
+	buffer           <-chan []*types.Record
+	progress         chan<- types.Cursor
+	exporter         exporter
+	endpoint         string
+	bufferFlushLimit int
+	flushInterval    time.Duration
+}
+
+// exporter sends a single export request, and returns whether it should be retried if it failed.
+type exporter interface {
+	export(req *collectorpb.ExportLogsServiceRequest) (bool, error)
+}
+
+func New(conf Config) (*Client, error) {
+	protocol := DefaultProtocol
+	if conf.Protocol != "" {
+		protocol = strings.ToLower(conf.Protocol)
+	}
+
+	timeout := DefaultTimeout
+	if conf.Timeout != time.Duration(0) {
+		timeout = conf.Timeout
+	}
+
+	var exp exporter
+	endpoint := conf.Endpoint
+	switch protocol {
+	case ProtocolHTTP:
+		if endpoint == "" {
+			endpoint = DefaultHTTPEndpoint
+		}
+		exp = newHTTPExporter(endpoint, conf, timeout)
+	case ProtocolGRPC:
+		if endpoint == "" {
+			endpoint = DefaultGRPCEndpoint
+		}
+		var err error
+		exp, err = newGRPCExporter(endpoint, conf, timeout)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Errorf("Unknown OTLP protocol %s", protocol)
+	}
+
+	limit := DefaultBufferFlushLimit
+	if conf.BufferFlushLimit != 0 {
+		limit = conf.BufferFlushLimit
+	}
+
+	interval := DefaultFlushInterval
+	if conf.FlushInterval != time.Duration(0) {
+		interval = conf.FlushInterval
+	}
+
+	return &Client{
+		exporter:         exp,
+		endpoint:         endpoint,
+		bufferFlushLimit: limit,
+		flushInterval:    interval,
+	}, nil
+}
+
+func (c *Client) Start(records <-chan *types.Record, progress chan<- types.Cursor) {
+	if c.buffer != nil {
+		panic(errors.New("Tried to start otlp output a second time"))
+	}
+	c.buffer = channel.NewBufferedChannel(c.bufferFlushLimit, c.flushInterval, records)
+	c.progress = progress
+	go c.deliver()
+}
+
+func (c *Client) deliver() {
+	for {
+		records, ok := <-c.buffer
+		if !ok {
+			logging.Logger.Warn("record channel was unexpectedly closed")
+			return
+		}
+
+		req := &collectorpb.ExportLogsServiceRequest{
+			ResourceLogs: toResourceLogs(records, time.Now()),
+		}
+
+		strategy := backoff.NewExponentialBackOff()
+		strategy.MaxElapsedTime = time.Hour * 1
+		err := backoff.Retry(func() error {
+			retry, err := c.exporter.export(req)
+			if err == nil {
+				return nil
+			}
+			logging.Logger.Error(fmt.Sprintf("failed to export logs: %s", err), zap.String("endpoint", c.endpoint))
+			if !retry {
+				// The collector rejected the batch, retrying won't help.
+				return nil
+			}
+			return err
+		}, strategy)
+		if err != nil {
+			panic(errors.Wrap(err, "Got unrecoverable error exporting to otlp endpoint"))
+		}
+		c.progress <- records[len(records)-1].Cursor
+	}
+}
+
+// Maps fields of the enrichment objects to resource attributes.
+var resourceFields = []struct {
+	path      string
+	attribute string
+}{
+	{"aws.instance_id", "host.id"},
+	{"aws.instance_type", "host.type"},
+	{"aws.local_hostname", "host.name"},
+	{"kubernetes.namespace_name", "k8s.namespace.name"},
+	{"kubernetes.pod_name", "k8s.pod.name"},
+	{"kubernetes.pod_id", "k8s.pod.uid"},
+	{"kubernetes.container_name", "k8s.container.name"},
+	{"kubernetes.node", "k8s.node.name"},
+	{"docker.container_id", "container.id"},
+}
+
+// Fields that are mapped onto the resource or the log record itself, rather than its attributes.
+var reservedFields = map[string]bool{
+	"log":               true,
+	"PRIORITY":          true,
+	types.FieldSeverity: true,
+	"aws":               true,
+	"kubernetes":        true,
+	"docker":            true,
+}
+
+// toResourceLogs converts a batch of records to log records, grouped by resource.
+func toResourceLogs(records []*types.Record, observed time.Time) []*logspb.ResourceLogs {
+	resourceLogs := []*logspb.ResourceLogs{}
+	byResource := make(map[string]*logspb.ScopeLogs)
+	for _, record := range records {
+		attributes := resourceAttributes(record)
+		key := resourceKey(attributes)
+		scope, ok := byResource[key]
+		if !ok {
+			scope = &logspb.ScopeLogs{
+				Scope: &commonpb.InstrumentationScope{Name: scopeName},
+			}
+			byResource[key] = scope
+			resourceLogs = append(resourceLogs, &logspb.ResourceLogs{
+				Resource:  &resourcepb.Resource{Attributes: attributes},
+				ScopeLogs: []*logspb.ScopeLogs{scope},
+			})
+		}
+		scope.LogRecords = append(scope.LogRecords, toLogRecord(record, observed))
+	}
+	return resourceLogs
+}
+
+func resourceAttributes(record *types.Record) []*commonpb.KeyValue {
+	attributes := []*commonpb.KeyValue{}
+	if _, ok := record.Fields["aws"]; ok {
+		attributes = append(attributes, stringAttribute("cloud.provider", "aws"))
+	}
+	for _, field := range resourceFields {
+		if value, ok := record.LookupString(field.path); ok && value != "" {
+			attributes = append(attributes, stringAttribute(field.attribute, value))
+		}
+	}
+	if labels, ok := record.Lookup("kubernetes.labels"); ok {
+		if labels, ok := labels.(map[string]string); ok {
+			keys := make([]string, 0, len(labels))
+			for k := range labels {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				attributes = append(attributes, stringAttribute("k8s.pod.label."+k, labels[k]))
+			}
+		}
+	}
+	return attributes
+}
+
+// resourceKey identifies a resource by its (ordered) attributes.
+func resourceKey(attributes []*commonpb.KeyValue) string {
+	var key strings.Builder
+	for _, attribute := range attributes {
+		key.WriteString(attribute.Key)
+		key.WriteByte('=')
+		key.WriteString(attribute.Value.GetStringValue())
+		key.WriteByte(0)
+	}
+	return key.String()
+}
+
+func toLogRecord(record *types.Record, observed time.Time) *logspb.LogRecord {
+	logRecord := &logspb.LogRecord{
+		ObservedTimeUnixNano: uint64(observed.UnixNano()),
+	}
+	if !record.Time.IsZero() {
+		logRecord.TimeUnixNano = uint64(record.Time.UnixNano())
+	}
+	if body, ok := record.Fields["log"]; ok {
+		logRecord.Body = toAnyValue(body)
+	}
+	if priority, ok := record.Fields["PRIORITY"]; ok {
+		logRecord.SeverityNumber, logRecord.SeverityText = severity(priority)
+	} else if name, ok := record.Fields[types.FieldSeverity].(string); ok {
+		logRecord.SeverityNumber, logRecord.SeverityText = severityByName(name)
+	}
+
+	keys := make([]string, 0, len(record.Fields))
+	for k := range record.Fields {
+		if !reservedFields[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		logRecord.Attributes = append(logRecord.Attributes, &commonpb.KeyValue{
+			Key:   k,
+			Value: toAnyValue(record.Fields[k]),
+		})
+	}
+	return logRecord
+}
+
+// OTLP severities of the syslog priorities (as used by journald), indexed by level like
+// types.SeverityNames.
+var severityNumbers = []logspb.SeverityNumber{
+	logspb.SeverityNumber_SEVERITY_NUMBER_FATAL4,
+	logspb.SeverityNumber_SEVERITY_NUMBER_FATAL3,
+	logspb.SeverityNumber_SEVERITY_NUMBER_FATAL,
+	logspb.SeverityNumber_SEVERITY_NUMBER_ERROR,
+	logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+	logspb.SeverityNumber_SEVERITY_NUMBER_INFO2,
+	logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+	logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG,
+}
+
+// severity converts a journald PRIORITY field to an OTLP severity.
+func severity(priority interface{}) (logspb.SeverityNumber, string) {
+	level, err := strconv.Atoi(fmt.Sprint(priority))
+	if err != nil || level < 0 || level >= len(severityNumbers) {
+		return logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED, ""
+	}
+	return severityNumbers[level], types.SeverityNames[level]
+}
+
+// severityByName converts a syslog severity name (e.g. warning) to an OTLP severity.
+func severityByName(name string) (logspb.SeverityNumber, string) {
+	for level, text := range types.SeverityNames {
+		if text == name {
+			return severityNumbers[level], text
+		}
+	}
+	return logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED, ""
+}
+
+func stringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
+
+// toAnyValue converts a field value to an OTLP value. Values that aren't JSON primitives, maps or
+// slices are converted through their JSON representation.
+func toAnyValue(value interface{}) *commonpb.AnyValue {
+	switch v := value.(type) {
+	case nil:
+		return &commonpb.AnyValue{}
+	case string:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}
+	case bool:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: v}}
+	case int:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(v)}}
+	case int64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: v}}
+	case float64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: v}}
+	case []byte:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BytesValue{BytesValue: v}}
+	case []interface{}:
+		values := make([]*commonpb.AnyValue, len(v))
+		for i, item := range v {
+			values[i] = toAnyValue(item)
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: values}}}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		values := make([]*commonpb.KeyValue, len(keys))
+		for i, k := range keys {
+			values[i] = &commonpb.KeyValue{Key: k, Value: toAnyValue(v[k])}
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{Values: values}}}
+	}
+
+	serialized, err := json.Marshal(value)
+	if err != nil {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: fmt.Sprint(value)}}
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(serialized, &decoded); err != nil {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: string(serialized)}}
+	}
+	return toAnyValue(decoded)
+}
+
+// HTTP status codes for which an export is retried, as defined by the OTLP specification.
+var retryableStatusCodes = map[int]bool{
+	http.StatusTooManyRequests:    true,
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
+}
+
+type httpExporter struct {
+	client  *http.Client
+	url     string
+	headers map[string]string
+	gzip    bool
+}
+
+func newHTTPExporter(url string, conf Config, timeout time.Duration) *httpExporter {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.TLSConfig != nil {
+		transport.TLSClientConfig = conf.TLSConfig
+	}
+	return &httpExporter{
+		client:  &http.Client{Timeout: timeout, Transport: transport},
+		url:     url,
+		headers: conf.Headers,
+		gzip:    conf.Gzip,
+	}
+}
+
+func (e *httpExporter) export(exportReq *collectorpb.ExportLogsServiceRequest) (bool, error) {
+	body, err := proto.Marshal(exportReq)
+	if err != nil {
+		return false, errors.Wrap(err, "Error marshaling export request")
+	}
+	if e.gzip {
+		var buf bytes.Buffer
+		gzipper := gzip.NewWriter(&buf)
+		gzipper.Write(body)
+		if err := gzipper.Close(); err != nil {
+			return false, errors.Wrap(err, "Error compressing export request")
+		}
+		body = buf.Bytes()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "Error constructing request")
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if e.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "Error sending request")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		respBody, err := ioutil.ReadAll(resp.Body)
+		if err == nil {
+			exportResp := &collectorpb.ExportLogsServiceResponse{}
+			if err := proto.Unmarshal(respBody, exportResp); err == nil {
+				logPartialSuccess(exportResp)
+			}
+		}
+		return false, nil
+	}
+	// Drain the body so the connection can be reused.
+	io.Copy(ioutil.Discard, resp.Body)
+	return retryableStatusCodes[resp.StatusCode], errors.Errorf("Got response status %s", resp.Status)
+}
+
+// gRPC status codes for which an export is retried, as defined by the OTLP specification.
+var retryableCodes = map[codes.Code]bool{
+	codes.Canceled:          true,
+	codes.DeadlineExceeded:  true,
+	codes.ResourceExhausted: true,
+	codes.Aborted:           true,
+	codes.OutOfRange:        true,
+	codes.Unavailable:       true,
+	codes.DataLoss:          true,
+}
+
+type grpcExporter struct {
+	client  collectorpb.LogsServiceClient
+	timeout time.Duration
+	headers metadata.MD
+	options []grpc.CallOption
+}
+
+func newGRPCExporter(endpoint string, conf Config, timeout time.Duration) (*grpcExporter, error) {
+	creds := credentials.NewTLS(conf.TLSConfig)
+	if conf.Insecure {
+		creds = insecure.NewCredentials()
+	}
+	// The connection is established lazily, and re-established by grpc when it breaks.
+	conn, err := grpc.Dial(endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error constructing grpc connection to %s", endpoint)
+	}
+
+	exp := &grpcExporter{
+		client:  collectorpb.NewLogsServiceClient(conn),
+		timeout: timeout,
+		headers: metadata.New(conf.Headers),
+	}
+	if conf.Gzip {
+		exp.options = append(exp.options, grpc.UseCompressor(grpcgzip.Name))
+	}
+	return exp, nil
+}
+
+func (e *grpcExporter) export(req *collectorpb.ExportLogsServiceRequest) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	ctx = metadata.NewOutgoingContext(ctx, e.headers)
+
+	resp, err := e.client.Export(ctx, req, e.options...)
+	if err != nil {
+		return retryableCodes[status.Code(err)], errors.Wrap(err, "Error exporting logs")
+	}
+	logPartialSuccess(resp)
+	return false, nil
+}
+
+// logPartialSuccess logs the records that the collector accepted the request for, but rejected.
+func logPartialSuccess(resp *collectorpb.ExportLogsServiceResponse) {
+	partial := resp.GetPartialSuccess()
+	if partial == nil || partial.GetRejectedLogRecords() == 0 {
+		return
+	}
+	logging.Logger.Warn("collector rejected log records",
+		zap.Int64("rejected", partial.GetRejectedLogRecords()), zap.String("message", partial.GetErrorMessage()))
+}
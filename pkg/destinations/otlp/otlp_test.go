@@ -0,0 +1,147 @@
+package otlp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/wearefair/log-aggregator/pkg/transform/journal"
+	"github.com/wearefair/log-aggregator/pkg/types"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+type podMetadata struct {
+	NamespaceName string            `json:"namespace_name,omitempty"`
+	PodName       string            `json:"pod_name,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+}
+
+func TestToResourceLogs(t *testing.T) {
+	now := time.Now()
+	records := []*types.Record{
+		{
+			Time: now,
+			Fields: map[string]interface{}{
+				"log":        "hello",
+				"PRIORITY":   "3",
+				"kubernetes": podMetadata{NamespaceName: "default", PodName: "a", Labels: map[string]string{"app": "web"}},
+				"extra":      map[string]interface{}{"count": float64(2)},
+			},
+		},
+		{Fields: map[string]interface{}{"log": "other", "kubernetes": podMetadata{NamespaceName: "default", PodName: "b"}}},
+		{Fields: map[string]interface{}{"log": "again", "kubernetes": podMetadata{NamespaceName: "default", PodName: "a", Labels: map[string]string{"app": "web"}}}},
+	}
+
+	resourceLogs := toResourceLogs(records, now)
+	if len(resourceLogs) != 2 {
+		t.Fatalf("Expected records to be grouped into 2 resources, but got %d", len(resourceLogs))
+	}
+
+	attributes := map[string]string{}
+	for _, attribute := range resourceLogs[0].Resource.Attributes {
+		attributes[attribute.Key] = attribute.Value.GetStringValue()
+	}
+	expected := map[string]string{"k8s.namespace.name": "default", "k8s.pod.name": "a", "k8s.pod.label.app": "web"}
+	for k, v := range expected {
+		if attributes[k] != v {
+			t.Errorf("Expected resource attribute %s to be %s, but got %s", k, v, attributes[k])
+		}
+	}
+
+	logRecords := resourceLogs[0].ScopeLogs[0].LogRecords
+	if len(logRecords) != 2 {
+		t.Fatalf("Expected 2 log records for pod a, but got %d", len(logRecords))
+	}
+	logRecord := logRecords[0]
+	if logRecord.Body.GetStringValue() != "hello" {
+		t.Errorf("Expected body to be hello, but got %v", logRecord.Body)
+	}
+	if logRecord.SeverityNumber != logspb.SeverityNumber_SEVERITY_NUMBER_ERROR || logRecord.SeverityText != "err" {
+		t.Errorf("Expected severity ERROR (err), but got %s (%s)", logRecord.SeverityNumber, logRecord.SeverityText)
+	}
+	if logRecord.TimeUnixNano != uint64(now.UnixNano()) {
+		t.Errorf("Expected time %d, but got %d", now.UnixNano(), logRecord.TimeUnixNano)
+	}
+	if len(logRecord.Attributes) != 1 || logRecord.Attributes[0].Key != "extra" {
+		t.Fatalf("Expected only the extra attribute, but got %v", logRecord.Attributes)
+	}
+	kvlist := logRecord.Attributes[0].Value.GetKvlistValue()
+	if kvlist == nil || len(kvlist.Values) != 1 || kvlist.Values[0].Value.GetDoubleValue() != 2 {
+		t.Errorf("Expected extra to be a kvlist with count 2, but got %v", logRecord.Attributes[0].Value)
+	}
+}
+
+func TestSeverity(t *testing.T) {
+	if number, text := severity("6"); number != logspb.SeverityNumber_SEVERITY_NUMBER_INFO || text != "info" {
+		t.Errorf("Expected priority 6 to be INFO (info), but got %s (%s)", number, text)
+	}
+	if number, _ := severity("bogus"); number != logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED {
+		t.Errorf("Expected unparseable priority to be unspecified, but got %s", number)
+	}
+}
+
+func TestJournalSeverity(t *testing.T) {
+	// The journal source drops PRIORITY by default, and only forwards the decoded severity.
+	record, err := journal.Transform(&types.Record{Fields: map[string]interface{}{
+		"MESSAGE":           "disk full",
+		types.FieldSeverity: "warning",
+		"_HOSTNAME":         "node-1",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logRecord := toLogRecord(record, time.Now())
+	if logRecord.SeverityNumber != logspb.SeverityNumber_SEVERITY_NUMBER_WARN || logRecord.SeverityText != "warning" {
+		t.Errorf("Expected severity WARN (warning), but got %s (%s)", logRecord.SeverityNumber, logRecord.SeverityText)
+	}
+	for _, attribute := range logRecord.Attributes {
+		if attribute.Key == types.FieldSeverity {
+			t.Errorf("Did not expect the severity to be an attribute")
+		}
+	}
+}
+
+func TestHTTPExport(t *testing.T) {
+	var received collectorpb.ExportLogsServiceRequest
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("Expected protobuf content type, but got %s", r.Header.Get("Content-Type"))
+		}
+		if r.Header.Get("X-Token") != "secret" {
+			t.Errorf("Expected X-Token header to be set")
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := proto.Unmarshal(body, &received); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	exp := newHTTPExporter(server.URL, Config{Headers: map[string]string{"X-Token": "secret"}}, time.Second)
+	req := &collectorpb.ExportLogsServiceRequest{
+		ResourceLogs: toResourceLogs([]*types.Record{{Fields: map[string]interface{}{"log": "hello"}}}, time.Now()),
+	}
+
+	if retry, err := exp.export(req); err == nil || !retry {
+		t.Errorf("Expected a retryable error for status 503, but got %v (retry %t)", err, retry)
+	}
+
+	status = http.StatusBadRequest
+	if retry, err := exp.export(req); err == nil || retry {
+		t.Errorf("Expected a permanent error for status 400, but got %v (retry %t)", err, retry)
+	}
+
+	status = http.StatusOK
+	if _, err := exp.export(req); err != nil {
+		t.Fatal(err)
+	}
+	if len(received.ResourceLogs) != 1 || received.ResourceLogs[0].ScopeLogs[0].LogRecords[0].Body.GetStringValue() != "hello" {
+		t.Errorf("Expected the server to receive the log record, but got %v", received.ResourceLogs)
+	}
+}
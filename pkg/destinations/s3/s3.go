@@ -0,0 +1,276 @@
+// Package s3 provides a destination that archives records directly to S3.
+//
+// Records are written as gzip'd newline delimited JSON, into objects partitioned by a key template.
+// Objects are rolled (uploaded) once they reach a maximum size or age, and cursors are only
+// published once every record up to that cursor has been uploaded.
+package s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/awsutil"
+	"github.com/wearefair/log-aggregator/pkg/logging"
+	"github.com/wearefair/log-aggregator/pkg/template"
+	"github.com/wearefair/log-aggregator/pkg/types"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultKeyTemplate partitions objects by date, hour, kubernetes namespace and host.
+	DefaultKeyTemplate   = `{{.Time.Format "2006-01-02"}}/{{.Time.Format "15"}}/{{.Field "kubernetes.namespace_name" | default "none"}}/{{hostname}}`
+	DefaultMaxObjectSize = 64 * 1024 * 1024
+	DefaultMaxObjectAge  = time.Minute * 5
+	DefaultPartSize      = 8 * 1024 * 1024
+
+	// Partition used for records that the key template fails to render for.
+	fallbackPartition = "unpartitioned"
+	// How often open objects are checked against the max age.
+	rollCheckInterval = time.Second
+)
+
+type Config struct {
+	EC2MetadataEndpoint string
+	Bucket              string
+	// KeyTemplate is rendered for each record (see the template package) to pick the
+	// key prefix of the object the record is written to.
+	KeyTemplate string
+	// MaxObjectSize is the compressed size at which an object is uploaded.
+	MaxObjectSize int
+	// MaxObjectAge is the time after which an object is uploaded, regardless of its size.
+	MaxObjectAge time.Duration
+	// PartSize is the part size used for multipart uploads of large objects.
+	PartSize int64
+}
+
+type Client struct {
+	uploader      s3manageriface.UploaderAPI
+	bucket        string
+	keyTemplate   *template.Template
+	maxObjectSize int
+	maxObjectAge  time.Duration
+	hostname      string
+
+	// Open objects by partition
+	objects  map[string]*object
+	seq      uint64
+	pending  []pendingCursor
+	progress chan<- types.Cursor
+	started  bool
+}
+
+// An object that is being written to, but hasn't been uploaded yet.
+type object struct {
+	partition string
+	created   time.Time
+	// Sequence number of the first record written to the object.
+	firstSeq uint64
+	records  int
+	buffer   *bytes.Buffer
+	writer   *gzip.Writer
+}
+
+// Cursor of a record that hasn't been committed yet.
+type pendingCursor struct {
+	seq    uint64
+	cursor types.Cursor
+}
+
+func New(conf Config) *Client {
+	sess := awsutil.NewSession(conf.EC2MetadataEndpoint)
+	region := awsutil.Region()
+	logging.Logger.Info("Setting aws region", zap.String("region", region))
+
+	partSize := conf.PartSize
+	if partSize == 0 {
+		partSize = DefaultPartSize
+	}
+	uploader := s3manager.NewUploaderWithClient(s3.New(sess, sess.Config.WithRegion(region)), func(u *s3manager.Uploader) {
+		u.PartSize = partSize
+	})
+	return newClient(conf, uploader)
+}
+
+func newClient(conf Config, uploader s3manageriface.UploaderAPI) *Client {
+	keyTemplate := DefaultKeyTemplate
+	if conf.KeyTemplate != "" {
+		keyTemplate = conf.KeyTemplate
+	}
+
+	maxObjectSize := DefaultMaxObjectSize
+	if conf.MaxObjectSize != 0 {
+		maxObjectSize = conf.MaxObjectSize
+	}
+
+	maxObjectAge := DefaultMaxObjectAge
+	if conf.MaxObjectAge != time.Duration(0) {
+		maxObjectAge = conf.MaxObjectAge
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return &Client{
+		uploader:      uploader,
+		bucket:        conf.Bucket,
+		keyTemplate:   template.Must(keyTemplate),
+		maxObjectSize: maxObjectSize,
+		maxObjectAge:  maxObjectAge,
+		hostname:      hostname,
+		objects:       make(map[string]*object),
+	}
+}
+
+func (c *Client) Start(records <-chan *types.Record, progress chan<- types.Cursor) {
+	if c.started {
+		panic(errors.New("Tried to start s3 output a second time"))
+	}
+	c.started = true
+	c.progress = progress
+	go c.deliver(records)
+}
+
+func (c *Client) deliver(records <-chan *types.Record) {
+	ticker := time.NewTicker(rollCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case record, ok := <-records:
+			if !ok {
+				logging.Logger.Warn("record channel was unexpectedly closed")
+				for _, obj := range c.objects {
+					c.upload(obj)
+				}
+				return
+			}
+			c.write(record)
+
+		case now := <-ticker.C:
+			c.rollExpired(now)
+		}
+	}
+}
+
+// write appends the record to the object for its partition, and uploads the object if it is full.
+func (c *Client) write(record *types.Record) {
+	c.seq++
+	c.pending = append(c.pending, pendingCursor{seq: c.seq, cursor: record.Cursor})
+
+	serialized, err := json.Marshal(record.Fields)
+	if err != nil {
+		logging.Error(errors.Wrap(err, "Failed to marshal record to json"))
+		return
+	}
+
+	partition, err := c.keyTemplate.Execute(record)
+	if err != nil || partition == "" {
+		if err != nil {
+			logging.Error(err)
+		}
+		partition = fallbackPartition
+	}
+
+	obj, ok := c.objects[partition]
+	if !ok {
+		obj = newObject(partition, c.seq)
+		c.objects[partition] = obj
+	}
+	obj.writer.Write(serialized)
+	obj.writer.Write([]byte("\n"))
+	obj.records++
+
+	if obj.buffer.Len() >= c.maxObjectSize {
+		c.upload(obj)
+	}
+}
+
+// rollExpired uploads all objects older than the max object age.
+func (c *Client) rollExpired(now time.Time) {
+	for _, obj := range c.objects {
+		if now.Sub(obj.created) >= c.maxObjectAge {
+			c.upload(obj)
+		}
+	}
+}
+
+// upload uploads an object, retrying until it succeeds (or panicking if it never does),
+// and then publishes the progress that has been made.
+func (c *Client) upload(obj *object) {
+	delete(c.objects, obj.partition)
+
+	err := obj.writer.Close()
+	if err != nil {
+		panic(errors.Wrap(err, "Error closing gzip writer"))
+	}
+	body := obj.buffer.Bytes()
+	key := fmt.Sprintf("%s/%s-%d.json.gz", obj.partition, c.hostname, obj.created.UnixNano())
+
+	strategy := backoff.NewExponentialBackOff()
+	strategy.MaxElapsedTime = time.Hour * 1
+	err = backoff.Retry(func() error {
+		_, err := c.uploader.Upload(&s3manager.UploadInput{
+			Bucket:          aws.String(c.bucket),
+			Key:             aws.String(key),
+			Body:            bytes.NewReader(body),
+			ContentType:     aws.String("application/x-ndjson"),
+			ContentEncoding: aws.String("gzip"),
+		})
+		if err != nil {
+			logging.Logger.Error(fmt.Sprintf("failed to upload object %s: %s", key, err))
+		}
+		return err
+	}, strategy)
+	if err != nil {
+		panic(errors.Wrap(err, "Got unrecoverable error uploading to s3"))
+	}
+	logging.Logger.Debug("Uploaded object", zap.String("key", key), zap.Int("records", obj.records))
+
+	c.commit()
+}
+
+// commit publishes the cursor of the newest record for which it and every record before it
+// has been uploaded.
+func (c *Client) commit() {
+	watermark := c.seq
+	for _, obj := range c.objects {
+		if obj.firstSeq-1 < watermark {
+			watermark = obj.firstSeq - 1
+		}
+	}
+
+	var cursor types.Cursor
+	index := 0
+	for index < len(c.pending) && c.pending[index].seq <= watermark {
+		cursor = c.pending[index].cursor
+		index++
+	}
+	if index == 0 {
+		return
+	}
+	c.pending = c.pending[index:]
+	c.progress <- cursor
+}
+
+func newObject(partition string, seq uint64) *object {
+	buffer := &bytes.Buffer{}
+	return &object{
+		partition: partition,
+		created:   time.Now(),
+		firstSeq:  seq,
+		buffer:    buffer,
+		writer:    gzip.NewWriter(buffer),
+	}
+}
@@ -0,0 +1,125 @@
+package s3
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+func TestWriteAndCommit(t *testing.T) {
+	uploader := &mockUploader{}
+	progress := make(chan types.Cursor, 10)
+	client := newClient(Config{
+		Bucket:        "mybucket",
+		KeyTemplate:   `{{.Field "namespace"}}`,
+		MaxObjectSize: 1024 * 1024,
+		MaxObjectAge:  time.Minute,
+	}, uploader)
+	client.progress = progress
+
+	client.write(&types.Record{Cursor: "1", Fields: map[string]interface{}{"namespace": "a", "log": "1"}})
+	client.write(&types.Record{Cursor: "2", Fields: map[string]interface{}{"namespace": "b", "log": "2"}})
+	client.write(&types.Record{Cursor: "3", Fields: map[string]interface{}{"namespace": "a", "log": "3"}})
+
+	if len(client.objects) != 2 {
+		t.Fatalf("Expected 2 open objects, but got %d", len(client.objects))
+	}
+
+	// Uploading partition b can't commit anything, as record 1 is still pending in partition a.
+	client.upload(client.objects["b"])
+	if len(progress) != 0 {
+		t.Fatalf("Expected no progress, but got cursor %s", <-progress)
+	}
+
+	// Uploading partition a commits everything.
+	client.upload(client.objects["a"])
+	if cursor := <-progress; cursor != types.Cursor("3") {
+		t.Errorf("Expected cursor 3 to be committed, but got %s", cursor)
+	}
+
+	if len(uploader.uploads) != 2 {
+		t.Fatalf("Expected 2 uploads, but got %d", len(uploader.uploads))
+	}
+	upload := uploader.uploads[1]
+	if *upload.input.Bucket != "mybucket" {
+		t.Errorf("Expected bucket to be mybucket, but got %s", *upload.input.Bucket)
+	}
+	if !strings.HasPrefix(*upload.input.Key, "a/") || !strings.HasSuffix(*upload.input.Key, ".json.gz") {
+		t.Errorf("Expected key a/*.json.gz, but got %s", *upload.input.Key)
+	}
+	if len(upload.lines) != 2 || upload.lines[0]["log"] != "1" || upload.lines[1]["log"] != "3" {
+		t.Errorf("Expected object to contain records 1 and 3, but got %v", upload.lines)
+	}
+}
+
+func TestRollBySizeAndAge(t *testing.T) {
+	uploader := &mockUploader{}
+	progress := make(chan types.Cursor, 10)
+	client := newClient(Config{
+		KeyTemplate:   `{{.Field "namespace"}}`,
+		MaxObjectSize: 1,
+		MaxObjectAge:  time.Minute,
+	}, uploader)
+	client.progress = progress
+
+	// The gzip header alone exceeds the max object size.
+	client.write(&types.Record{Cursor: "1", Fields: map[string]interface{}{"namespace": "a"}})
+	if len(uploader.uploads) != 1 {
+		t.Fatalf("Expected object to be rolled by size, but got %d uploads", len(uploader.uploads))
+	}
+	if cursor := <-progress; cursor != types.Cursor("1") {
+		t.Errorf("Expected cursor 1 to be committed, but got %s", cursor)
+	}
+
+	client.maxObjectSize = DefaultMaxObjectSize
+	client.write(&types.Record{Cursor: "2", Fields: map[string]interface{}{"namespace": "a"}})
+	client.rollExpired(time.Now())
+	if len(uploader.uploads) != 1 {
+		t.Fatalf("Expected object not to be rolled before max age, but got %d uploads", len(uploader.uploads))
+	}
+	client.rollExpired(time.Now().Add(time.Minute))
+	if len(uploader.uploads) != 2 {
+		t.Fatalf("Expected object to be rolled by age, but got %d uploads", len(uploader.uploads))
+	}
+	if cursor := <-progress; cursor != types.Cursor("2") {
+		t.Errorf("Expected cursor 2 to be committed, but got %s", cursor)
+	}
+}
+
+type mockUpload struct {
+	input *s3manager.UploadInput
+	lines []map[string]interface{}
+}
+
+type mockUploader struct {
+	uploads []mockUpload
+}
+
+func (u *mockUploader) Upload(input *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	upload := mockUpload{input: input}
+	reader, err := gzip.NewReader(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, err
+		}
+		upload.lines = append(upload.lines, line)
+	}
+	u.uploads = append(u.uploads, upload)
+	return &s3manager.UploadOutput{}, nil
+}
+
+func (u *mockUploader) UploadWithContext(ctx aws.Context, input *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	return u.Upload(input, opts...)
+}
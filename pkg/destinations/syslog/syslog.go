@@ -0,0 +1,393 @@
+// Package syslog provides a destination that forwards records to a syslog server, formatted as
+// RFC 5424 messages.
+//
+// Messages are sent over UDP (one message per datagram), or over TCP or TLS using octet-counting
+// framing (RFC 6587). Selected record fields can be included as structured data. The cursor of a
+// batch is published once all of its messages have been written.
+package syslog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/channel"
+	"github.com/wearefair/log-aggregator/pkg/logging"
+	"github.com/wearefair/log-aggregator/pkg/template"
+	"github.com/wearefair/log-aggregator/pkg/types"
+	"go.uber.org/zap"
+)
+
+const (
+	NetworkUDP = "udp"
+	NetworkTCP = "tcp"
+	NetworkTLS = "tls"
+
+	DefaultNetwork = NetworkTCP
+	// The journal source drops SYSLOG_IDENTIFIER and _HOSTNAME by default, so the defaults fall back to
+	// fields that are still there after the journal source and transformer.
+	DefaultAppNameTemplate = `{{.Field "SYSLOG_IDENTIFIER" | default (.Field "kubernetes.container_name") | ` +
+		`default (.Field "JD_SYSTEMD_UNIT") | default (.Field "JD_COMM") | default "log-aggregator"}}`
+	DefaultHostnameTemplate = `{{.Field "JD_HOSTNAME" | default (.Field "aws.local_hostname") | default hostname}}`
+	DefaultStructuredDataID = "fields@32473"
+	DefaultFacility         = 1 // user-level messages
+	DefaultSeverity         = 6 // informational
+	// RFC 5426 only guarantees datagrams up to this size are handled.
+	DefaultUDPMaxMessageSize = 2048
+	DefaultBufferFlushLimit  = 500
+	DefaultFlushInterval     = time.Second * 1
+	DefaultTimeout           = time.Second * 30
+
+	timestampFormat = "2006-01-02T15:04:05.000000Z07:00"
+	// The "-" value for empty header fields and structured data.
+	nilValue = "-"
+)
+
+type Config struct {
+	// Network is one of udp, tcp or tls.
+	Network string
+	// Address of the server, host:port
+	Address   string
+	TLSConfig *tls.Config
+	// AppNameTemplate and HostnameTemplate are rendered for each record (see the template package)
+	// to fill in the APP-NAME and HOSTNAME header fields.
+	AppNameTemplate  string
+	HostnameTemplate string
+	// StructuredDataFields are the (nested) record fields that are sent as parameters of a single
+	// structured data element, identified by StructuredDataID.
+	StructuredDataFields []string
+	StructuredDataID     string
+	// Facility is used for records without a SYSLOG_FACILITY or facility field. Zero (kernel) means the
+	// default.
+	Facility int
+	// MaxMessageSize truncates longer messages. Defaults to no limit for tcp and tls.
+	MaxMessageSize   int
+	Timeout          time.Duration
+	BufferFlushLimit int
+	FlushInterval    time.Duration
+}
+
+type Client struct {
+	buffer           <-chan []*types.Record
+	progress         chan<- types.Cursor
+	network          string
+	address          string
+	tlsConfig        *tls.Config
+	appName          *template.Template
+	hostname         *template.Template
+	sdFields         []string
+	sdID             string
+	facility         int
+	maxMessageSize   int
+	timeout          time.Duration
+	bufferFlushLimit int
+	flushInterval    time.Duration
+	conn             net.Conn
+	writer           *bufio.Writer
+}
+
+func New(conf Config) (*Client, error) {
+	network := DefaultNetwork
+	if conf.Network != "" {
+		network = strings.ToLower(conf.Network)
+	}
+	if network != NetworkUDP && network != NetworkTCP && network != NetworkTLS {
+		return nil, errors.Errorf("Unknown syslog network %s", network)
+	}
+
+	appNameTemplate := DefaultAppNameTemplate
+	if conf.AppNameTemplate != "" {
+		appNameTemplate = conf.AppNameTemplate
+	}
+	appName, err := template.New(appNameTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	hostnameTemplate := DefaultHostnameTemplate
+	if conf.HostnameTemplate != "" {
+		hostnameTemplate = conf.HostnameTemplate
+	}
+	hostname, err := template.New(hostnameTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	sdID := DefaultStructuredDataID
+	if conf.StructuredDataID != "" {
+		sdID = conf.StructuredDataID
+	}
+
+	facility := DefaultFacility
+	if conf.Facility != 0 {
+		facility = conf.Facility
+	}
+
+	maxMessageSize := conf.MaxMessageSize
+	if maxMessageSize == 0 && network == NetworkUDP {
+		maxMessageSize = DefaultUDPMaxMessageSize
+	}
+
+	timeout := DefaultTimeout
+	if conf.Timeout != time.Duration(0) {
+		timeout = conf.Timeout
+	}
+
+	limit := DefaultBufferFlushLimit
+	if conf.BufferFlushLimit != 0 {
+		limit = conf.BufferFlushLimit
+	}
+
+	interval := DefaultFlushInterval
+	if conf.FlushInterval != time.Duration(0) {
+		interval = conf.FlushInterval
+	}
+
+	return &Client{
+		network:          network,
+		address:          conf.Address,
+		tlsConfig:        conf.TLSConfig,
+		appName:          appName,
+		hostname:         hostname,
+		sdFields:         conf.StructuredDataFields,
+		sdID:             sdID,
+		facility:         facility,
+		maxMessageSize:   maxMessageSize,
+		timeout:          timeout,
+		bufferFlushLimit: limit,
+		flushInterval:    interval,
+	}, nil
+}
+
+func (c *Client) Start(records <-chan *types.Record, progress chan<- types.Cursor) {
+	if c.buffer != nil {
+		panic(errors.New("Tried to start syslog output a second time"))
+	}
+	c.buffer = channel.NewBufferedChannel(c.bufferFlushLimit, c.flushInterval, records)
+	c.progress = progress
+	go c.deliver()
+}
+
+func (c *Client) deliver() {
+	for {
+		records, ok := <-c.buffer
+		if !ok {
+			logging.Logger.Warn("record channel was unexpectedly closed")
+			c.close()
+			return
+		}
+
+		messages := make([][]byte, 0, len(records))
+		for _, record := range records {
+			messages = append(messages, c.format(record))
+		}
+
+		strategy := backoff.NewExponentialBackOff()
+		strategy.MaxElapsedTime = time.Hour * 1
+		err := backoff.Retry(func() error {
+			err := c.send(messages)
+			if err != nil {
+				logging.Logger.Error(fmt.Sprintf("failed to send syslog messages: %s", err),
+					zap.String("address", c.address))
+				// Reconnect on the next attempt.
+				c.close()
+			}
+			return err
+		}, strategy)
+		if err != nil {
+			panic(errors.Wrap(err, "Got unrecoverable error sending to syslog server"))
+		}
+		c.progress <- records[len(records)-1].Cursor
+	}
+}
+
+// send writes messages to the server, framed according to the network.
+func (c *Client) send(messages [][]byte) error {
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return err
+		}
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	for _, msg := range messages {
+		if c.network == NetworkUDP {
+			// Each datagram holds a single message, so no framing is needed.
+			if _, err := c.conn.Write(msg); err != nil {
+				return errors.Wrap(err, "Error writing message")
+			}
+			continue
+		}
+		if _, err := c.writer.WriteString(strconv.Itoa(len(msg)) + " "); err != nil {
+			return errors.Wrap(err, "Error writing message")
+		}
+		if _, err := c.writer.Write(msg); err != nil {
+			return errors.Wrap(err, "Error writing message")
+		}
+	}
+	if c.writer != nil {
+		if err := c.writer.Flush(); err != nil {
+			return errors.Wrap(err, "Error writing message")
+		}
+	}
+	return nil
+}
+
+// format renders a record as an RFC 5424 message:
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func (c *Client) format(record *types.Record) []byte {
+	recordTime := record.Time
+	if recordTime.IsZero() {
+		recordTime = time.Now()
+	}
+
+	// The journal source forwards the decoded severity and facility names instead of the raw fields by
+	// default.
+	severity := fieldInt(record, "PRIORITY", 0, 7, fieldName(record, types.FieldSeverity, types.SeverityNames, DefaultSeverity))
+	facility := fieldInt(record, "SYSLOG_FACILITY", 0, 23, fieldName(record, types.FieldFacility, types.FacilityNames, c.facility))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %s %s ",
+		facility*8+severity,
+		recordTime.UTC().Format(timestampFormat),
+		headerField(c.render(c.hostname, record), 255),
+		headerField(c.render(c.appName, record), 48),
+		headerField(field(record, "JD_PID"), 128),
+		nilValue,
+	)
+	c.writeStructuredData(&buf, record)
+	if msg := field(record, "log"); msg != "" {
+		buf.WriteByte(' ')
+		buf.WriteString(msg)
+	}
+
+	msg := buf.Bytes()
+	if c.maxMessageSize > 0 && len(msg) > c.maxMessageSize {
+		msg = msg[:c.maxMessageSize]
+	}
+	return msg
+}
+
+// writeStructuredData writes a single SD-ELEMENT with the configured fields, or the nil value if
+// none of them are present.
+func (c *Client) writeStructuredData(buf *bytes.Buffer, record *types.Record) {
+	var params bytes.Buffer
+	for _, path := range c.sdFields {
+		value, ok := record.LookupString(path)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&params, ` %s="%s"`, sdName(path), sdEscaper.Replace(value))
+	}
+	if params.Len() == 0 {
+		buf.WriteString(nilValue)
+		return
+	}
+	buf.WriteByte('[')
+	buf.WriteString(sdName(c.sdID))
+	buf.Write(params.Bytes())
+	buf.WriteByte(']')
+}
+
+func (c *Client) render(tmpl *template.Template, record *types.Record) string {
+	value, err := tmpl.Execute(record)
+	if err != nil {
+		logging.Error(err)
+		return ""
+	}
+	return value
+}
+
+// Characters that must be escaped in structured data parameter values.
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// sdName sanitizes a structured data id or parameter name.
+func sdName(name string) string {
+	return sanitize(name, 32, func(r rune) bool {
+		return r == '=' || r == ']' || r == '"'
+	})
+}
+
+// headerField sanitizes a header field, using the nil value if it is empty.
+func headerField(value string, maxLength int) string {
+	if value == "" {
+		return nilValue
+	}
+	return sanitize(value, maxLength, func(rune) bool { return false })
+}
+
+// sanitize replaces characters outside of printable US-ASCII (and any rejected ones) with
+// underscores, and truncates the value.
+func sanitize(value string, maxLength int, reject func(rune) bool) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 || reject(r) {
+			return '_'
+		}
+		return r
+	}, value)
+	if len(sanitized) > maxLength {
+		sanitized = sanitized[:maxLength]
+	}
+	return sanitized
+}
+
+func field(record *types.Record, path string) string {
+	value, _ := record.LookupString(path)
+	return value
+}
+
+// fieldName converts a field holding one of the names to its index, or returns the fallback if it's
+// missing or unknown.
+func fieldName(record *types.Record, path string, names []string, fallback int) int {
+	value := field(record, path)
+	for i, name := range names {
+		if name == value {
+			return i
+		}
+	}
+	return fallback
+}
+
+// fieldInt returns the integer value of a field, or the fallback if it's missing or out of range.
+func fieldInt(record *types.Record, path string, min, max, fallback int) int {
+	value, err := strconv.Atoi(field(record, path))
+	if err != nil || value < min || value > max {
+		return fallback
+	}
+	return value
+}
+
+func (c *Client) connect() error {
+	dialer := &net.Dialer{Timeout: c.timeout}
+	var conn net.Conn
+	var err error
+	switch c.network {
+	case NetworkTLS:
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.address, c.tlsConfig)
+	default:
+		conn, err = dialer.Dial(c.network, c.address)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Error connecting to %s", c.address)
+	}
+	c.conn = conn
+	if c.network != NetworkUDP {
+		c.writer = bufio.NewWriter(conn)
+	}
+	return nil
+}
+
+func (c *Client) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.writer = nil
+	}
+}
@@ -0,0 +1,131 @@
+package syslog
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/wearefair/log-aggregator/pkg/transform/journal"
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+func TestFormat(t *testing.T) {
+	client, err := New(Config{
+		HostnameTemplate:     "host 1",
+		StructuredDataFields: []string{"kubernetes.pod_name", "missing", "quoted"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := &types.Record{
+		Time: time.Date(2019, 11, 4, 12, 30, 0, 5000, time.UTC),
+		Fields: map[string]interface{}{
+			"log":               "hello world",
+			"PRIORITY":          "3",
+			"SYSLOG_FACILITY":   "4",
+			"SYSLOG_IDENTIFIER": "sshd",
+			"JD_PID":            "42",
+			"kubernetes":        map[string]interface{}{"pod_name": "web-1"},
+			"quoted":            `a "b" [c] \d`,
+		},
+	}
+	expected := `<35>1 2019-11-04T12:30:00.000005Z host_1 sshd 42 - ` +
+		`[fields@32473 kubernetes.pod_name="web-1" quoted="a \"b\" [c\] \\d"] hello world`
+	if formatted := string(client.format(record)); formatted != expected {
+		t.Errorf("Expected\n%s\nbut got\n%s", expected, formatted)
+	}
+
+	record = &types.Record{
+		Time:   time.Date(2019, 11, 4, 12, 30, 0, 0, time.UTC),
+		Fields: map[string]interface{}{"PRIORITY": "bogus"},
+	}
+	expected = `<14>1 2019-11-04T12:30:00.000000Z host_1 log-aggregator - - -`
+	if formatted := string(client.format(record)); formatted != expected {
+		t.Errorf("Expected\n%s\nbut got\n%s", expected, formatted)
+	}
+}
+
+func TestFormatJournal(t *testing.T) {
+	client, err := New(Config{HostnameTemplate: "host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The journal source drops the raw syslog fields by default, and forwards the decoded ones.
+	record, err := journal.Transform(&types.Record{
+		Time: time.Date(2019, 11, 4, 12, 30, 0, 0, time.UTC),
+		Fields: map[string]interface{}{
+			"MESSAGE":           "Accepted publickey",
+			types.FieldSeverity: "notice",
+			types.FieldFacility: "authpriv",
+			"_SYSTEMD_UNIT":     "ssh.service",
+			"_PID":              "42",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<85>1 2019-11-04T12:30:00.000000Z host ssh.service 42 - - Accepted publickey`
+	if formatted := string(client.format(record)); formatted != expected {
+		t.Errorf("Expected\n%s\nbut got\n%s", expected, formatted)
+	}
+}
+
+func TestSendOctetCounted(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			length, err := reader.ReadString(' ')
+			if err != nil {
+				return
+			}
+			size, err := strconv.Atoi(length[:len(length)-1])
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			msg := make([]byte, size)
+			if _, err := io.ReadFull(reader, msg); err != nil {
+				t.Error(err)
+				return
+			}
+			received <- string(msg)
+		}
+	}()
+
+	client, err := New(Config{Address: listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.close()
+
+	messages := [][]byte{[]byte("<14>1 first message"), []byte("<14>1 second\nmessage")}
+	if err := client.send(messages); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range messages {
+		select {
+		case msg := <-received:
+			if msg != string(expected) {
+				t.Errorf("Expected %q, but got %q", expected, msg)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Timed out waiting for message")
+		}
+	}
+}
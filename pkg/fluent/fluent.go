@@ -0,0 +1,60 @@
+// Package fluent contains the types of the Fluentd Forward protocol that are shared by the forward
+// source and destination.
+//
+// See https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1
+package fluent
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// EventTimeExtID is the msgpack extension type of EventTime
+const EventTimeExtID = 0
+
+// CompressionGzip is the only compression supported by the protocol (CompressedPackedForward mode)
+const CompressionGzip = "gzip"
+
+func init() {
+	msgpack.RegisterExt(EventTimeExtID, (*EventTime)(nil))
+}
+
+// EventTime is a timestamp with nanosecond precision, encoded as a msgpack extension.
+type EventTime struct {
+	time.Time
+}
+
+func (t *EventTime) MarshalMsgpack() ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(t.Nanosecond()))
+	return b, nil
+}
+
+func (t *EventTime) UnmarshalMsgpack(b []byte) error {
+	if len(b) != 8 {
+		return errors.Errorf("Invalid EventTime length: got %d, wanted 8", len(b))
+	}
+	seconds := binary.BigEndian.Uint32(b)
+	nanoseconds := binary.BigEndian.Uint32(b[4:])
+	t.Time = time.Unix(int64(seconds), int64(nanoseconds))
+	return nil
+}
+
+// Option is the last element of every message, and carries metadata about the message.
+type Option struct {
+	// Size is the number of events in the message.
+	Size int `msgpack:"size,omitempty"`
+	// Chunk is set by clients that expect the server to acknowledge the message.
+	Chunk string `msgpack:"chunk,omitempty"`
+	// Compressed is set to gzip for CompressedPackedForward messages.
+	Compressed string `msgpack:"compressed,omitempty"`
+}
+
+// Ack is the response sent by a server for messages that had a chunk option.
+type Ack struct {
+	Ack string `msgpack:"ack"`
+}
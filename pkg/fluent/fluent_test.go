@@ -0,0 +1,32 @@
+package fluent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+func TestEventTime(t *testing.T) {
+	eventTime := &EventTime{time.Unix(1487349663, 588456153)}
+	encoded, err := msgpack.Marshal(eventTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fixext8 with type 0
+	if len(encoded) != 10 || encoded[0] != 0xd7 || encoded[1] != EventTimeExtID {
+		t.Errorf("Expected EventTime to be encoded as fixext8 with type 0, but got %x", encoded)
+	}
+
+	var decoded interface{}
+	if err := msgpack.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	decodedTime, ok := decoded.(*EventTime)
+	if !ok {
+		t.Fatalf("Expected to decode an EventTime, but got %T", decoded)
+	}
+	if !decodedTime.Equal(eventTime.Time) {
+		t.Errorf("Expected time to be %s, but got %s", eventTime.Time, decodedTime.Time)
+	}
+}
@@ -15,7 +15,9 @@ type Pipeline struct {
 	progress chan types.Cursor
 	input    chan *types.Record
 	output   chan *types.Record
-	conf     Config
+	// Asks the transform loop to flush every held record, and is closed once it did.
+	flush chan chan struct{}
+	conf  Config
 }
 
 type Config struct {
@@ -24,8 +26,13 @@ type Config struct {
 	Input        sources.Source
 	Destination  destinations.Destination
 	Transformers []transform.Transformer
+	// Flushers are flushed every FlushInterval. Flushed records are sent to the destination as they are,
+	// so transformers that hold records back should be the last ones.
+	Flushers []transform.Flusher
 }
 
+const FlushInterval = time.Second
+
 func New(conf Config) (*Pipeline, error) {
 	input := make(chan *types.Record, conf.MaxBuffer)
 	output := make(chan *types.Record, 20)
@@ -35,6 +42,7 @@ func New(conf Config) (*Pipeline, error) {
 		input:    input,
 		output:   output,
 		progress: progress,
+		flush:    make(chan chan struct{}, 1),
 		conf:     conf,
 	}, nil
 }
@@ -46,31 +54,76 @@ func (p *Pipeline) Start() {
 	go p.syncCursor()
 }
 
+// Stop stops the source, sends the records that transformers hold back, and gives the destination
+// the rest of the timeout to send them.
 func (p *Pipeline) Stop(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
 	p.conf.Input.Stop()
-	time.Sleep(timeout)
+	flushed := make(chan struct{})
+	p.flush <- flushed
+	select {
+	case <-flushed:
+	case <-time.After(timeout):
+	}
+	time.Sleep(time.Until(deadline))
 }
 
 func (p *Pipeline) transform() {
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
 	for {
-		record, open := <-p.input
-		if !open {
-			return
+		select {
+		case record, open := <-p.input:
+			if !open {
+				return
+			}
+			p.process(record)
+
+		case now := <-ticker.C:
+			p.flushAll(now)
+
+		case flushed := <-p.flush:
+			// Records that the source already queued are held back too.
+			for len(p.input) > 0 {
+				p.process(<-p.input)
+			}
+			// Far enough in the future for every held record to time out.
+			p.flushAll(time.Now().AddDate(1, 0, 0))
+			close(flushed)
 		}
+	}
+}
 
-		for _, transformer := range p.conf.Transformers {
-			record, _ = transformer(record)
+func (p *Pipeline) process(record *types.Record) {
+	for _, transformer := range p.conf.Transformers {
+		if record, _ = transformer(record); record == nil {
+			break
 		}
+	}
+	if record != nil {
 		p.output <- record
 	}
 }
 
+func (p *Pipeline) flushAll(now time.Time) {
+	for _, flusher := range p.conf.Flushers {
+		for _, record := range flusher.Flush(now) {
+			p.output <- record
+		}
+	}
+}
+
 func (p *Pipeline) syncCursor() {
 	for {
 		cursor, open := <-p.progress
 		if !open {
 			return
 		}
+		// Sources that can't resume (e.g. network listeners) leave the cursor empty, which must not
+		// overwrite the cursor of another source.
+		if cursor == "" {
+			continue
+		}
 		strategy := backoff.NewExponentialBackOff()
 		strategy.MaxElapsedTime = time.Second * 15
 		err := backoff.Retry(func() error {
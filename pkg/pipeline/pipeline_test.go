@@ -0,0 +1,70 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wearefair/log-aggregator/pkg/transform"
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+type mockSource struct{}
+
+func (s *mockSource) Start(chan<- *types.Record) {}
+func (s *mockSource) Stop()                      {}
+
+type mockDestination struct {
+	records chan *types.Record
+}
+
+func (d *mockDestination) Start(records <-chan *types.Record, progress chan<- types.Cursor) {
+	go func() {
+		for record := range records {
+			d.records <- record
+		}
+	}()
+}
+
+// mockFlusher holds a record until it times out.
+type mockFlusher struct {
+	held    *types.Record
+	timeout time.Time
+}
+
+func (f *mockFlusher) Flush(now time.Time) []*types.Record {
+	if f.held == nil || now.Before(f.timeout) {
+		return nil
+	}
+	held := f.held
+	f.held = nil
+	return []*types.Record{held}
+}
+
+func TestStop(t *testing.T) {
+	held := &types.Record{Fields: map[string]interface{}{"log": "held"}}
+	destination := &mockDestination{records: make(chan *types.Record, 1)}
+	p, err := New(Config{
+		Input:       &mockSource{},
+		Destination: destination,
+		Flushers:    []transform.Flusher{&mockFlusher{held: held, timeout: time.Now().Add(time.Hour)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+
+	timeout := time.Millisecond * 200
+	start := time.Now()
+	p.Stop(timeout)
+	if elapsed := time.Since(start); elapsed > timeout+time.Millisecond*100 {
+		t.Errorf("Expected Stop to return within %s, but it took %s", timeout, elapsed)
+	}
+	select {
+	case record := <-destination.records:
+		if record != held {
+			t.Errorf("Expected the held record, but got %v", record.Fields)
+		}
+	default:
+		t.Errorf("Expected the held record to be flushed on stop")
+	}
+}
@@ -0,0 +1,206 @@
+// Package cri provides a source that tails Kubernetes container log files written by CRI runtimes
+// (e.g. containerd), under /var/log/pods/<namespace>_<pod>_<uid>/<container>/<restart>.log
+//
+// Each line has the format "<timestamp> <stream> <P|F> <message>", where P marks a partial line that
+// is continued by the following lines of the same stream. Partial lines are joined into a single
+// record. The namespace, pod name, pod UID and container name are taken from the path, and stored
+// in the K8S_* fields that the k8 transformer uses.
+//
+// Cursors are position snapshots (see the tail package), so records can be repeated after a restart.
+package cri
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/logging"
+	"github.com/wearefair/log-aggregator/pkg/tail"
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+const (
+	DefaultDirectory   = "/var/log/pods"
+	DefaultMaxLineSize = 1024 * 1024
+
+	// Fields holding the pod and container a record was read for.
+	FieldNamespace     = "K8S_NAMESPACE"
+	FieldPodName       = "K8S_POD_NAME"
+	FieldPodUID        = "K8S_POD_UID"
+	FieldContainerName = "K8S_CONTAINER_NAME"
+
+	tagPartial = "P"
+	tagFull    = "F"
+)
+
+type Config struct {
+	// Directory that contains the pod log directories
+	Directory string
+	Cursor    types.Cursor
+	// ReadFromHead reads files that already exist on the first start (without a cursor) from the
+	// beginning, instead of only reading new lines.
+	ReadFromHead bool
+	// MaxLineSize is the largest message that partial lines are joined into.
+	MaxLineSize int
+}
+
+type Client struct {
+	out         chan<- *types.Record
+	stop        chan struct{}
+	directory   string
+	maxLineSize int
+	tailer      *tail.Tailer
+}
+
+// fileHandler handles the lines of a single log file.
+type fileHandler struct {
+	client *Client
+	path   string
+	fields map[string]string
+	// Messages of partial lines, by stream.
+	partial map[string]*partialLine
+}
+
+type partialLine struct {
+	time    time.Time
+	message []byte
+}
+
+func New(conf Config) (*Client, error) {
+	directory := DefaultDirectory
+	if conf.Directory != "" {
+		directory = conf.Directory
+	}
+	if _, err := os.Stat(directory); err != nil {
+		return nil, errors.Wrapf(err, "Error reading pod log directory %s", directory)
+	}
+
+	maxLineSize := DefaultMaxLineSize
+	if conf.MaxLineSize != 0 {
+		maxLineSize = conf.MaxLineSize
+	}
+
+	client := &Client{
+		stop:        make(chan struct{}),
+		directory:   directory,
+		maxLineSize: maxLineSize,
+	}
+	client.tailer = tail.New(tail.Config{
+		Pattern:      filepath.Join(directory, "*", "*", "*.log"),
+		Cursor:       conf.Cursor,
+		ReadFromHead: conf.ReadFromHead,
+	}, client)
+	return client, nil
+}
+
+func (c *Client) Start(out chan<- *types.Record) {
+	c.out = out
+	go c.tailer.Run(c.stop)
+}
+
+func (c *Client) Stop() {
+	close(c.stop)
+}
+
+// Open implements tail.Handler
+func (c *Client) Open(path string) (tail.LineHandler, error) {
+	name, err := filepath.Rel(c.directory, path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unexpected pod log path %s", path)
+	}
+	fields, err := parsePath(name)
+	if err != nil {
+		return nil, err
+	}
+	return &fileHandler{
+		client:  c,
+		path:    path,
+		fields:  fields,
+		partial: make(map[string]*partialLine),
+	}, nil
+}
+
+func (h *fileHandler) Line(line []byte, cursor types.Cursor) bool {
+	lineTime, stream, tag, message, err := parseLine(line)
+	if err != nil {
+		logging.Error(errors.Wrapf(err, "Error parsing line in %s", h.path))
+	} else if partial, ok := h.partial[stream]; ok || tag == tagPartial {
+		if !ok {
+			partial = &partialLine{time: lineTime}
+			h.partial[stream] = partial
+		}
+		partial.message = append(partial.message, message...)
+		if tag == tagFull || len(partial.message) >= h.client.maxLineSize {
+			delete(h.partial, stream)
+			h.send(partial.time, stream, partial.message, cursor)
+		}
+	} else {
+		h.send(lineTime, stream, message, cursor)
+	}
+	return len(h.partial) == 0
+}
+
+func (h *fileHandler) Close(cursor types.Cursor) {
+	// Don't lose partial lines that will never be completed.
+	for stream, partial := range h.partial {
+		h.send(partial.time, stream, partial.message, cursor)
+	}
+}
+
+func (h *fileHandler) send(recordTime time.Time, stream string, message []byte, cursor types.Cursor) {
+	fields := map[string]interface{}{
+		"log":    string(message),
+		"stream": stream,
+	}
+	for k, v := range h.fields {
+		fields[k] = v
+	}
+	h.client.out <- &types.Record{
+		Time:   recordTime,
+		Cursor: cursor,
+		Fields: fields,
+	}
+}
+
+// parseLine parses a line in the CRI format: <timestamp> <stream> <P|F> <message>
+func parseLine(line []byte) (time.Time, string, string, []byte, error) {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	parts := bytes.SplitN(line, []byte(" "), 4)
+	if len(parts) < 3 {
+		return time.Time{}, "", "", nil, errors.Errorf("Invalid CRI log line: %s", line)
+	}
+	lineTime, err := time.Parse(time.RFC3339Nano, string(parts[0]))
+	if err != nil {
+		return time.Time{}, "", "", nil, errors.Wrapf(err, "Invalid timestamp in CRI log line: %s", line)
+	}
+	tag := string(parts[2])
+	if tag != tagPartial && tag != tagFull {
+		return time.Time{}, "", "", nil, errors.Errorf("Invalid tag in CRI log line: %s", line)
+	}
+	var message []byte
+	if len(parts) == 4 {
+		message = parts[3]
+	}
+	return lineTime, string(parts[1]), tag, message, nil
+}
+
+// parsePath extracts the pod and container fields from a path: <namespace>_<pod>_<uid>/<container>/<n>.log
+func parsePath(name string) (map[string]string, error) {
+	parts := strings.Split(filepath.ToSlash(name), "/")
+	if len(parts) != 3 {
+		return nil, errors.Errorf("Unexpected pod log path %s", name)
+	}
+	pod := strings.Split(parts[0], "_")
+	if len(pod) != 3 {
+		return nil, errors.Errorf("Unexpected pod log directory %s", parts[0])
+	}
+	return map[string]string{
+		FieldNamespace:     pod[0],
+		FieldPodName:       pod[1],
+		FieldPodUID:        pod[2],
+		FieldContainerName: parts[1],
+	}, nil
+}
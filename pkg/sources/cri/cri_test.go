@@ -0,0 +1,103 @@
+package cri
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+func TestParseLine(t *testing.T) {
+	lineTime, stream, tag, message, err := parseLine([]byte("2019-11-04T12:30:00.123456789Z stderr F hello world\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lineTime.Equal(time.Date(2019, 11, 4, 12, 30, 0, 123456789, time.UTC)) {
+		t.Errorf("Unexpected time %s", lineTime)
+	}
+	if stream != "stderr" || tag != "F" || string(message) != "hello world" {
+		t.Errorf("Unexpected stream %s, tag %s, or message %s", stream, tag, message)
+	}
+
+	if _, _, _, message, err := parseLine([]byte("2019-11-04T12:30:00Z stdout F\n")); err != nil || len(message) != 0 {
+		t.Errorf("Expected empty line to parse, but got %q (%v)", message, err)
+	}
+	if _, _, _, _, err := parseLine([]byte("not a cri line\n")); err == nil {
+		t.Errorf("Expected an error for an invalid line")
+	}
+}
+
+func TestTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cri")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	containerDir := filepath.Join(dir, "default_web-1_1234-abcd", "nginx")
+	if err := os.MkdirAll(containerDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(containerDir, "0.log")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.WriteString("2019-11-04T12:30:00Z stdout F existing\n")
+
+	out := make(chan *types.Record, 10)
+	client, err := New(Config{Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.out = out
+	now := time.Now()
+
+	// Lines that existed before the first start are skipped.
+	client.tailer.Poll(now)
+	if len(out) != 0 {
+		t.Fatalf("Expected existing lines to be skipped, but got %d records", len(out))
+	}
+
+	file.WriteString("2019-11-04T12:30:01Z stdout P hello \n")
+	file.WriteString("2019-11-04T12:30:02Z stderr F error\n")
+	file.WriteString("2019-11-04T12:30:03Z stdout F world\n")
+	file.WriteString("2019-11-04T12:30:04Z stdout F incomplete")
+	client.tailer.Poll(now)
+
+	record := <-out
+	if record.Fields["log"] != "error" || record.Fields["stream"] != "stderr" {
+		t.Errorf("Expected stderr line, but got %v", record.Fields)
+	}
+	record = <-out
+	if record.Fields["log"] != "hello world" || record.Fields["stream"] != "stdout" {
+		t.Errorf("Expected partial lines to be joined, but got %v", record.Fields)
+	}
+	if !record.Time.Equal(time.Date(2019, 11, 4, 12, 30, 1, 0, time.UTC)) {
+		t.Errorf("Expected the time of the first partial line, but got %s", record.Time)
+	}
+	expected := map[string]string{
+		FieldNamespace:     "default",
+		FieldPodName:       "web-1",
+		FieldPodUID:        "1234-abcd",
+		FieldContainerName: "nginx",
+	}
+	for k, v := range expected {
+		if record.Fields[k] != v {
+			t.Errorf("Expected %s to be %s, but got %v", k, v, record.Fields[k])
+		}
+	}
+	if len(out) != 0 {
+		t.Fatalf("Expected the incomplete line to wait, but got %v", (<-out).Fields)
+	}
+
+	file.WriteString(" line\n")
+	client.tailer.Poll(now)
+	if record := <-out; record.Fields["log"] != "incomplete line" {
+		t.Errorf("Expected the completed line, but got %v", record.Fields)
+	}
+}
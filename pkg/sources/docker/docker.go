@@ -0,0 +1,243 @@
+// Package docker provides a source that tails the log files of Docker's json-file log driver, under
+// /var/lib/docker/containers/<id>/<id>-json.log
+//
+// Records are shaped like the ones the journald log driver writes (MESSAGE, CONTAINER_NAME,
+// CONTAINER_ID_FULL, etc), so the same transformers work for both. The container name, image and
+// labels are read from the container's config.v2.json. Lines that Docker split because they were too
+// long are joined into a single record.
+//
+// Cursors are position snapshots (see the tail package), so records can be repeated after a restart.
+package docker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/logging"
+	"github.com/wearefair/log-aggregator/pkg/tail"
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+const (
+	DefaultDirectory   = "/var/lib/docker/containers"
+	DefaultMaxLineSize = 1024 * 1024
+
+	configFile = "config.v2.json"
+)
+
+type Config struct {
+	// Directory that contains the container directories
+	Directory string
+	Cursor    types.Cursor
+	// ReadFromHead reads files that already exist on the first start (without a cursor) from the
+	// beginning, instead of only reading new lines.
+	ReadFromHead bool
+	// Labels are the container labels that are added to records, like the labels option of the
+	// journald log driver.
+	Labels []string
+	// MaxLineSize is the largest message that split lines are joined into.
+	MaxLineSize int
+}
+
+type Client struct {
+	out         chan<- *types.Record
+	stop        chan struct{}
+	labels      []string
+	maxLineSize int
+	tailer      *tail.Tailer
+}
+
+// A line written by the json-file log driver
+type logLine struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// The parts of config.v2.json that are used
+type containerConfig struct {
+	ID     string `json:"ID"`
+	Name   string `json:"Name"`
+	Config struct {
+		Image  string            `json:"Image"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+}
+
+// fileHandler handles the lines of a single container's log file.
+type fileHandler struct {
+	client *Client
+	path   string
+	fields map[string]string
+	// Messages of split lines, by stream.
+	partial map[string]*partialLine
+}
+
+type partialLine struct {
+	time    time.Time
+	message string
+}
+
+func New(conf Config) (*Client, error) {
+	directory := DefaultDirectory
+	if conf.Directory != "" {
+		directory = conf.Directory
+	}
+	if _, err := os.Stat(directory); err != nil {
+		return nil, errors.Wrapf(err, "Error reading container directory %s", directory)
+	}
+
+	maxLineSize := DefaultMaxLineSize
+	if conf.MaxLineSize != 0 {
+		maxLineSize = conf.MaxLineSize
+	}
+
+	client := &Client{
+		stop:        make(chan struct{}),
+		labels:      conf.Labels,
+		maxLineSize: maxLineSize,
+	}
+	client.tailer = tail.New(tail.Config{
+		Pattern:      filepath.Join(directory, "*", "*-json.log"),
+		Cursor:       conf.Cursor,
+		ReadFromHead: conf.ReadFromHead,
+	}, client)
+	return client, nil
+}
+
+func (c *Client) Start(out chan<- *types.Record) {
+	c.out = out
+	go c.tailer.Run(c.stop)
+}
+
+func (c *Client) Stop() {
+	close(c.stop)
+}
+
+// Open implements tail.Handler
+func (c *Client) Open(path string) (tail.LineHandler, error) {
+	id := filepath.Base(filepath.Dir(path))
+	config, err := readConfig(filepath.Join(filepath.Dir(path), configFile))
+	if err != nil {
+		// Still forward the logs, just without the container details.
+		logging.Error(err)
+		config = &containerConfig{ID: id}
+	}
+	return &fileHandler{
+		client:  c,
+		path:    path,
+		fields:  c.containerFields(config),
+		partial: make(map[string]*partialLine),
+	}, nil
+}
+
+// containerFields returns the fields the journald log driver adds for a container.
+func (c *Client) containerFields(config *containerConfig) map[string]string {
+	fields := map[string]string{
+		"CONTAINER_ID_FULL": config.ID,
+		"CONTAINER_ID":      config.ID,
+	}
+	if len(config.ID) > 12 {
+		fields["CONTAINER_ID"] = config.ID[:12]
+	}
+	if config.Name != "" {
+		fields["CONTAINER_NAME"] = strings.TrimPrefix(config.Name, "/")
+	}
+	if config.Config.Image != "" {
+		fields["IMAGE_NAME"] = config.Config.Image
+	}
+	for _, label := range c.labels {
+		if value, ok := config.Config.Labels[label]; ok {
+			fields[sanitizeLabel(label)] = value
+		}
+	}
+	return fields
+}
+
+func readConfig(path string) (*containerConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error reading container config %s", path)
+	}
+	var config containerConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.Wrapf(err, "Error parsing container config %s", path)
+	}
+	return &config, nil
+}
+
+func (h *fileHandler) Line(line []byte, cursor types.Cursor) bool {
+	var parsed logLine
+	if err := json.Unmarshal(line, &parsed); err != nil {
+		logging.Error(errors.Wrapf(err, "Error parsing line in %s", h.path))
+		return len(h.partial) == 0
+	}
+
+	// Lines that don't end with a newline were split by the log driver, and continue on the next line.
+	complete := strings.HasSuffix(parsed.Log, "\n")
+	message := strings.TrimSuffix(parsed.Log, "\n")
+	partial, ok := h.partial[parsed.Stream]
+	if !ok && complete {
+		h.send(parsed.Time, parsed.Stream, message, cursor)
+		return len(h.partial) == 0
+	}
+
+	if !ok {
+		partial = &partialLine{time: parsed.Time}
+		h.partial[parsed.Stream] = partial
+	}
+	partial.message += message
+	if complete || len(partial.message) >= h.client.maxLineSize {
+		delete(h.partial, parsed.Stream)
+		h.send(partial.time, parsed.Stream, partial.message, cursor)
+	}
+	return len(h.partial) == 0
+}
+
+func (h *fileHandler) Close(cursor types.Cursor) {
+	// Don't lose split lines that will never be completed.
+	for stream, partial := range h.partial {
+		h.send(partial.time, stream, partial.message, cursor)
+	}
+}
+
+func (h *fileHandler) send(recordTime time.Time, stream string, message string, cursor types.Cursor) {
+	fields := map[string]interface{}{
+		"MESSAGE":  message,
+		"PRIORITY": priority(stream),
+	}
+	for k, v := range h.fields {
+		fields[k] = v
+	}
+	h.client.out <- &types.Record{
+		Time:   recordTime,
+		Cursor: cursor,
+		Fields: fields,
+	}
+}
+
+// priority returns the syslog priority the journald log driver uses for a stream.
+func priority(stream string) string {
+	if stream == "stderr" {
+		return "3"
+	}
+	return "6"
+}
+
+// sanitizeLabel converts a label to a field name the way the journald log driver does: upper case,
+// with anything other than letters and digits replaced by underscores.
+func sanitizeLabel(label string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if r <= unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, label)
+	return strings.TrimLeft(sanitized, "_")
+}
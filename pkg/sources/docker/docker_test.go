@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+const containerID = "3b9a0a6c5d7e8f90123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	containerDir := filepath.Join(dir, containerID)
+	if err := os.MkdirAll(containerDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := `{"ID":"` + containerID + `","Name":"/k8s_nginx_web-1_default_1234_0",` +
+		`"Config":{"Image":"nginx:1.17","Labels":{"io.kubernetes.pod.name":"web-1","other":"x"}}}`
+	if err := ioutil.WriteFile(filepath.Join(containerDir, configFile), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logs := `{"log":"hello ","stream":"stdout","time":"2019-11-04T12:30:00.5Z"}` + "\n" +
+		`{"log":"oops\n","stream":"stderr","time":"2019-11-04T12:30:01Z"}` + "\n" +
+		`{"log":"world\n","stream":"stdout","time":"2019-11-04T12:30:02Z"}` + "\n"
+	if err := ioutil.WriteFile(filepath.Join(containerDir, containerID+"-json.log"), []byte(logs), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := make(chan *types.Record, 10)
+	client, err := New(Config{
+		Directory:    dir,
+		ReadFromHead: true,
+		Labels:       []string{"io.kubernetes.pod.name"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.out = out
+	client.tailer.Poll(time.Now())
+
+	record := <-out
+	if record.Fields["MESSAGE"] != "oops" || record.Fields["PRIORITY"] != "3" {
+		t.Errorf("Expected stderr line, but got %v", record.Fields)
+	}
+
+	record = <-out
+	if record.Fields["MESSAGE"] != "hello world" || record.Fields["PRIORITY"] != "6" {
+		t.Errorf("Expected split lines to be joined, but got %v", record.Fields)
+	}
+	if !record.Time.Equal(time.Date(2019, 11, 4, 12, 30, 0, 500000000, time.UTC)) {
+		t.Errorf("Expected the time of the first line, but got %s", record.Time)
+	}
+	expected := map[string]string{
+		"CONTAINER_ID_FULL":      containerID,
+		"CONTAINER_ID":           containerID[:12],
+		"CONTAINER_NAME":         "k8s_nginx_web-1_default_1234_0",
+		"IMAGE_NAME":             "nginx:1.17",
+		"IO_KUBERNETES_POD_NAME": "web-1",
+	}
+	for k, v := range expected {
+		if record.Fields[k] != v {
+			t.Errorf("Expected %s to be %s, but got %v", k, v, record.Fields[k])
+		}
+	}
+	if _, ok := record.Fields["OTHER"]; ok {
+		t.Errorf("Did not expect labels that weren't configured")
+	}
+}
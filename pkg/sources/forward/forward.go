@@ -0,0 +1,444 @@
+// Package forward provides a source that receives records from Fluentd clients (fluent-logger
+// libraries, the Docker fluentd log driver, Fluent Bit, etc) over the Forward protocol.
+//
+// All modes are supported: Message, Forward, PackedForward and CompressedPackedForward. Messages
+// with a chunk option are acknowledged once all of their events have been queued in the pipeline.
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+	"github.com/vmihailenco/msgpack/codes"
+	"github.com/wearefair/log-aggregator/pkg/fluent"
+	"github.com/wearefair/log-aggregator/pkg/logging"
+	"github.com/wearefair/log-aggregator/pkg/types"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultAddress  = ":24224"
+	DefaultTagField = "tag"
+	DefaultTimeout  = time.Second * 30
+	// Twice the default chunk size of Fluentd buffers.
+	DefaultMaxMessageSize = 1024 * 1024 * 16
+)
+
+var errMessageTooLarge = errors.New("Message is too large")
+
+type Config struct {
+	// Address to listen on, host:port
+	Address string
+	// TLSConfig enables TLS when set
+	TLSConfig *tls.Config
+	// TagField is the record field the tag of each event is stored in.
+	TagField string
+	// Timeout for writing acks.
+	Timeout time.Duration
+	// MaxMessageSize limits the size of a message, and of the decompressed entries of a
+	// CompressedPackedForward message. Connections that send larger messages are closed.
+	MaxMessageSize int
+}
+
+type Client struct {
+	out      chan<- *types.Record
+	listener net.Listener
+	tagField string
+	timeout  time.Duration
+	maxSize  int
+
+	lock     sync.Mutex
+	conns    map[net.Conn]bool
+	shutdown bool
+}
+
+// An event decoded from a message, before it is converted to a record.
+type event struct {
+	time   time.Time
+	fields map[string]interface{}
+}
+
+func New(conf Config) (*Client, error) {
+	address := DefaultAddress
+	if conf.Address != "" {
+		address = conf.Address
+	}
+
+	tagField := DefaultTagField
+	if conf.TagField != "" {
+		tagField = conf.TagField
+	}
+
+	timeout := DefaultTimeout
+	if conf.Timeout != time.Duration(0) {
+		timeout = conf.Timeout
+	}
+
+	maxSize := DefaultMaxMessageSize
+	if conf.MaxMessageSize != 0 {
+		maxSize = conf.MaxMessageSize
+	}
+
+	var listener net.Listener
+	var err error
+	if conf.TLSConfig != nil {
+		listener, err = tls.Listen("tcp", address, conf.TLSConfig)
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error listening on %s", address)
+	}
+
+	return &Client{
+		listener: listener,
+		tagField: tagField,
+		timeout:  timeout,
+		maxSize:  maxSize,
+		conns:    make(map[net.Conn]bool),
+	}, nil
+}
+
+func (c *Client) Start(out chan<- *types.Record) {
+	c.out = out
+	go c.accept()
+}
+
+// Stop closes the listener and all open connections.
+func (c *Client) Stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.shutdown = true
+	c.listener.Close()
+	for conn := range c.conns {
+		conn.Close()
+	}
+}
+
+func (c *Client) accept() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			if c.isShutdown() {
+				return
+			}
+			logging.Error(errors.Wrap(err, "Error accepting forward connection"))
+			time.Sleep(time.Millisecond * 500)
+			continue
+		}
+		if !c.track(conn) {
+			conn.Close()
+			return
+		}
+		go c.handle(conn)
+	}
+}
+
+// handle reads messages from a connection until it is closed.
+func (c *Client) handle(conn net.Conn) {
+	defer c.untrack(conn)
+	// The limit is counted as the connection is read, so it's only exact up to the size of the buffer.
+	limiter := &sizeLimiter{reader: conn}
+	decoder := msgpack.NewDecoder(bufio.NewReader(limiter))
+	for {
+		limiter.remaining = c.maxSize
+		tag, events, option, err := decodeMessage(decoder, c.maxSize)
+		if err != nil {
+			if err != io.EOF && !c.isShutdown() {
+				logging.Logger.Error(fmt.Sprintf("failed to read forward message: %s", err),
+					zap.String("remote", conn.RemoteAddr().String()))
+			}
+			return
+		}
+
+		for _, e := range events {
+			c.out <- c.toRecord(tag, e)
+		}
+
+		if option.Chunk != "" {
+			conn.SetWriteDeadline(time.Now().Add(c.timeout))
+			if err := msgpack.NewEncoder(conn).Encode(&fluent.Ack{Ack: option.Chunk}); err != nil {
+				logging.Logger.Error(fmt.Sprintf("failed to ack forward message: %s", err),
+					zap.String("remote", conn.RemoteAddr().String()))
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) toRecord(tag string, e event) *types.Record {
+	e.fields[c.tagField] = tag
+	// Clients resend what wasn't acked, so records have no cursor to resume from.
+	return &types.Record{
+		Time:   e.time,
+		Fields: e.fields,
+	}
+}
+
+func (c *Client) track(conn net.Conn) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.shutdown {
+		return false
+	}
+	c.conns[conn] = true
+	return true
+}
+
+func (c *Client) untrack(conn net.Conn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	conn.Close()
+	delete(c.conns, conn)
+}
+
+func (c *Client) isShutdown() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.shutdown
+}
+
+// decodeMessage reads a single message in any of the modes:
+//
+//	Message:                   [tag, time, record, option?]
+//	Forward:                   [tag, [[time, record], ...], option?]
+//	(Compressed)PackedForward: [tag, entries, option?]
+func decodeMessage(d *msgpack.Decoder, maxSize int) (string, []event, fluent.Option, error) {
+	var option fluent.Option
+	size, err := d.DecodeArrayLen()
+	if err != nil {
+		return "", nil, option, err
+	}
+	if size < 2 || size > 4 {
+		return "", nil, option, errors.Errorf("Invalid message with %d elements", size)
+	}
+	tag, err := d.DecodeString()
+	if err != nil {
+		return "", nil, option, errors.Wrap(err, "Error decoding tag")
+	}
+
+	code, err := d.PeekCode()
+	if err != nil {
+		return "", nil, option, err
+	}
+	var events []event
+	var packed []byte
+	remaining := size - 1
+	switch {
+	case codes.IsFixedArray(code) || code == codes.Array16 || code == codes.Array32:
+		count, err := d.DecodeArrayLen()
+		if err != nil {
+			return "", nil, option, err
+		}
+		for i := 0; i < count; i++ {
+			e, err := decodeEntry(d)
+			if err != nil {
+				return "", nil, option, err
+			}
+			events = append(events, e)
+		}
+		remaining--
+	case codes.IsString(code) || codes.IsBin(code):
+		packed, err = d.DecodeBytes()
+		if err != nil {
+			return "", nil, option, errors.Wrap(err, "Error decoding packed entries")
+		}
+		remaining--
+	default:
+		if size < 3 {
+			return "", nil, option, errors.New("Invalid message without a record")
+		}
+		e, err := decodeEvent(d)
+		if err != nil {
+			return "", nil, option, err
+		}
+		events = append(events, e)
+		remaining -= 2
+	}
+
+	if remaining > 1 {
+		return "", nil, option, errors.Errorf("Invalid message with %d elements", size)
+	}
+	if remaining == 1 {
+		if err := decodeOption(d, &option); err != nil {
+			return "", nil, option, err
+		}
+	}
+
+	if packed != nil {
+		events, err = decodePacked(packed, option.Compressed, maxSize)
+		if err != nil {
+			return "", nil, option, err
+		}
+	}
+	return tag, events, option, nil
+}
+
+// decodePacked decodes the entries of a (Compressed)PackedForward message.
+func decodePacked(packed []byte, compressed string, maxSize int) ([]event, error) {
+	var reader io.Reader = bytes.NewReader(packed)
+	if compressed == fluent.CompressionGzip {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error decompressing entries")
+		}
+		defer gzipReader.Close()
+		reader = &sizeLimiter{reader: gzipReader, remaining: maxSize}
+	} else if compressed != "" {
+		return nil, errors.Errorf("Unsupported compression %s", compressed)
+	}
+
+	var events []event
+	decoder := msgpack.NewDecoder(reader)
+	for {
+		e, err := decodeEntry(decoder)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+}
+
+// sizeLimiter fails reads once the remaining size has been read, unlike io.LimitReader which would
+// silently truncate messages.
+type sizeLimiter struct {
+	reader    io.Reader
+	remaining int
+}
+
+func (l *sizeLimiter) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// Only fail if there is more to read.
+		if n, err := l.reader.Read(make([]byte, 1)); n == 0 && err != nil {
+			return 0, err
+		}
+		return 0, errMessageTooLarge
+	}
+	if len(p) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.reader.Read(p)
+	l.remaining -= n
+	return n, err
+}
+
+// decodeEntry decodes an entry: [time, record]
+func decodeEntry(d *msgpack.Decoder) (event, error) {
+	size, err := d.DecodeArrayLen()
+	if err != nil {
+		return event{}, err
+	}
+	if size != 2 {
+		return event{}, errors.Errorf("Invalid entry with %d elements", size)
+	}
+	return decodeEvent(d)
+}
+
+// decodeEvent decodes a time followed by a record.
+func decodeEvent(d *msgpack.Decoder) (event, error) {
+	value, err := d.DecodeInterface()
+	if err != nil {
+		return event{}, errors.Wrap(err, "Error decoding event time")
+	}
+	eventTime, err := toTime(value)
+	if err != nil {
+		return event{}, err
+	}
+
+	value, err = d.DecodeInterface()
+	if err != nil {
+		return event{}, errors.Wrap(err, "Error decoding record")
+	}
+	fields, ok := normalize(value).(map[string]interface{})
+	if !ok {
+		return event{}, errors.Errorf("Invalid record of type %T", value)
+	}
+	return event{time: eventTime, fields: fields}, nil
+}
+
+func decodeOption(d *msgpack.Decoder, option *fluent.Option) error {
+	code, err := d.PeekCode()
+	if err != nil {
+		return err
+	}
+	if code == codes.Nil {
+		return d.DecodeNil()
+	}
+	if err := d.Decode(option); err != nil {
+		return errors.Wrap(err, "Error decoding option")
+	}
+	return nil
+}
+
+// toTime converts an event time, which is either an EventTime or an integer number of seconds.
+func toTime(value interface{}) (time.Time, error) {
+	switch t := value.(type) {
+	case *fluent.EventTime:
+		return t.Time, nil
+	case fluent.EventTime:
+		return t.Time, nil
+	case int8:
+		return time.Unix(int64(t), 0), nil
+	case int16:
+		return time.Unix(int64(t), 0), nil
+	case int32:
+		return time.Unix(int64(t), 0), nil
+	case int64:
+		return time.Unix(t, 0), nil
+	case uint8:
+		return time.Unix(int64(t), 0), nil
+	case uint16:
+		return time.Unix(int64(t), 0), nil
+	case uint32:
+		return time.Unix(int64(t), 0), nil
+	case uint64:
+		return time.Unix(int64(t), 0), nil
+	case float32:
+		return floatTime(float64(t)), nil
+	case float64:
+		return floatTime(t), nil
+	}
+	return time.Time{}, errors.Errorf("Invalid event time of type %T", value)
+}
+
+func floatTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// normalize converts decoded values so that they can be marshaled to json: binary strings become
+// strings, and maps are keyed by strings.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = normalize(v[i])
+		}
+		return v
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = normalize(v[k])
+		}
+		return v
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			converted[fmt.Sprint(normalize(k))] = normalize(val)
+		}
+		return converted
+	}
+	return value
+}
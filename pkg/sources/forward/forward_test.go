@@ -0,0 +1,146 @@
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+	"github.com/wearefair/log-aggregator/pkg/fluent"
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+func TestModes(t *testing.T) {
+	client, err := New(Config{Address: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan *types.Record, 10)
+	client.Start(out)
+	defer client.Stop()
+
+	conn, err := net.Dial("tcp", client.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	encoder := msgpack.NewEncoder(conn)
+	eventTime := time.Unix(1500000000, 123456789)
+
+	// Message mode, with an integer time
+	send(t, encoder, "app.message", int64(1500000000), map[string]interface{}{"log": "message"})
+	expectRecord(t, out, "app.message", "message", time.Unix(1500000000, 0))
+
+	// Forward mode
+	send(t, encoder, "app.forward", []interface{}{
+		[]interface{}{&fluent.EventTime{Time: eventTime}, map[string]interface{}{"log": "forward 1"}},
+		[]interface{}{&fluent.EventTime{Time: eventTime}, map[string]interface{}{"log": "forward 2"}},
+	})
+	expectRecord(t, out, "app.forward", "forward 1", eventTime)
+	expectRecord(t, out, "app.forward", "forward 2", eventTime)
+
+	// PackedForward mode
+	var packed bytes.Buffer
+	packedEncoder := msgpack.NewEncoder(&packed)
+	packedEncoder.Encode([]interface{}{&fluent.EventTime{Time: eventTime}, map[string]interface{}{"log": "packed"}})
+	send(t, encoder, "app.packed", packed.Bytes())
+	expectRecord(t, out, "app.packed", "packed", eventTime)
+
+	// CompressedPackedForward mode, with an ack
+	var compressed bytes.Buffer
+	gzipper := gzip.NewWriter(&compressed)
+	msgpack.NewEncoder(gzipper).Encode([]interface{}{&fluent.EventTime{Time: eventTime}, map[string]interface{}{
+		"log":    "compressed",
+		"nested": map[string]interface{}{"key": []byte("value")},
+	}})
+	gzipper.Close()
+	send(t, encoder, "app.compressed", compressed.Bytes(), &fluent.Option{Chunk: "abc", Compressed: fluent.CompressionGzip})
+	record := expectRecord(t, out, "app.compressed", "compressed", eventTime)
+	if val, _ := record.LookupString("nested.key"); val != "value" {
+		t.Errorf("Expected nested binary value to be converted to a string, but got %v", record.Fields["nested"])
+	}
+
+	var ack fluent.Ack
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if err := msgpack.NewDecoder(conn).Decode(&ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.Ack != "abc" {
+		t.Errorf("Expected ack for chunk abc, but got %s", ack.Ack)
+	}
+}
+
+func send(t *testing.T, encoder *msgpack.Encoder, tag string, values ...interface{}) {
+	if err := encoder.Encode(append([]interface{}{tag}, values...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectRecord(t *testing.T, out <-chan *types.Record, tag string, log string, recordTime time.Time) *types.Record {
+	select {
+	case record := <-out:
+		if record.Fields["tag"] != tag {
+			t.Errorf("Expected tag %s, but got %v", tag, record.Fields["tag"])
+		}
+		if record.Fields["log"] != log {
+			t.Errorf("Expected log %s, but got %v", log, record.Fields["log"])
+		}
+		if !record.Time.Equal(recordTime) {
+			t.Errorf("Expected time %s, but got %s", recordTime, record.Time)
+		}
+		return record
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Timed out waiting for record with log %s", log)
+	}
+	return nil
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	client, err := New(Config{Address: "127.0.0.1:0", MaxMessageSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan *types.Record, 10)
+	client.Start(out)
+	defer client.Stop()
+	eventTime := time.Unix(1500000000, 0)
+
+	for _, compress := range []bool{false, true} {
+		conn, err := net.Dial("tcp", client.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		encoder := msgpack.NewEncoder(conn)
+
+		send(t, encoder, "app.small", eventTime.Unix(), map[string]interface{}{"log": "small"})
+		expectRecord(t, out, "app.small", "small", eventTime)
+
+		large := map[string]interface{}{"log": string(bytes.Repeat([]byte("a"), 2048))}
+		if compress {
+			// Compresses to less than the limit, but the entries are larger.
+			var compressed bytes.Buffer
+			gzipper := gzip.NewWriter(&compressed)
+			msgpack.NewEncoder(gzipper).Encode([]interface{}{&fluent.EventTime{Time: eventTime}, large})
+			gzipper.Close()
+			send(t, encoder, "app.large", compressed.Bytes(), &fluent.Option{Compressed: fluent.CompressionGzip})
+		} else {
+			send(t, encoder, "app.large", eventTime.Unix(), large)
+		}
+
+		// The connection is closed without forwarding the message.
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("Expected the connection to be closed")
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Errorf("Expected the connection to be closed, but timed out")
+		}
+		select {
+		case record := <-out:
+			t.Errorf("Did not expect a record, but got %+v", record.Fields)
+		default:
+		}
+	}
+}
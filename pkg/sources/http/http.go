@@ -0,0 +1,280 @@
+// Package http provides a source that accepts records POSTed by applications over HTTP.
+//
+// Request bodies are newline delimited JSON objects, or a JSON array of objects, and can be gzip'd.
+// A request only succeeds once all of its records have been queued in the pipeline. When the
+// pipeline can't keep up, requests are rejected with 429 (or 503 if queueing timed out), and
+// clients are expected to retry.
+//
+// Delivery is at-most-once: queued records are only held in memory, and have no cursor, so the
+// records that were acknowledged but not yet sent by the destination are lost if the aggregator
+// stops or crashes.
+package http
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/logging"
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+const (
+	DefaultAddress         = ":8686"
+	DefaultPath            = "/logs"
+	DefaultMaxBodySize     = 10 * 1024 * 1024
+	DefaultQueueTimeout    = time.Second * 5
+	DefaultShutdownTimeout = time.Second * 10
+	DefaultReadTimeout     = time.Second * 30
+
+	// Clients that take longer to send the request headers are disconnected.
+	readHeaderTimeout = time.Second * 10
+
+	// Seconds that clients are asked to wait before retrying a rejected request.
+	retryAfter = 1
+)
+
+type Config struct {
+	// Address to listen on, host:port
+	Address string
+	// Path that records are POSTed to
+	Path string
+	// MaxBodySize is the largest (decompressed) request body that is accepted.
+	MaxBodySize int64
+	// QueueTimeout is how long a request waits for space in the pipeline, before it is rejected.
+	QueueTimeout time.Duration
+	// ReadTimeout is how long a client has to send a whole request, including the body.
+	ReadTimeout time.Duration
+}
+
+type Client struct {
+	out          chan<- *types.Record
+	listener     net.Listener
+	server       *http.Server
+	path         string
+	maxBodySize  int64
+	queueTimeout time.Duration
+
+	lock     sync.RWMutex
+	shutdown bool
+}
+
+func New(conf Config) (*Client, error) {
+	address := DefaultAddress
+	if conf.Address != "" {
+		address = conf.Address
+	}
+
+	path := DefaultPath
+	if conf.Path != "" {
+		path = conf.Path
+	}
+
+	maxBodySize := int64(DefaultMaxBodySize)
+	if conf.MaxBodySize != 0 {
+		maxBodySize = conf.MaxBodySize
+	}
+
+	queueTimeout := DefaultQueueTimeout
+	if conf.QueueTimeout != time.Duration(0) {
+		queueTimeout = conf.QueueTimeout
+	}
+
+	readTimeout := DefaultReadTimeout
+	if conf.ReadTimeout != time.Duration(0) {
+		readTimeout = conf.ReadTimeout
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error listening on %s", address)
+	}
+
+	client := &Client{
+		listener:     listener,
+		path:         path,
+		maxBodySize:  maxBodySize,
+		queueTimeout: queueTimeout,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, client.handle)
+	client.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+	}
+	return client, nil
+}
+
+func (c *Client) Start(out chan<- *types.Record) {
+	c.out = out
+	go func() {
+		err := c.server.Serve(c.listener)
+		if err != nil && err != http.ErrServerClosed {
+			panic(errors.Wrap(err, "Error serving http source"))
+		}
+	}()
+}
+
+// Stop rejects new requests, and waits for in-flight requests to finish.
+func (c *Client) Stop() {
+	c.lock.Lock()
+	c.shutdown = true
+	c.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	if err := c.server.Shutdown(ctx); err != nil {
+		logging.Error(errors.Wrap(err, "Error shutting down http source"))
+	}
+}
+
+func (c *Client) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	records, err := c.decode(r)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == errBodyTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	status := c.enqueue(records)
+	if status != http.StatusOK {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"accepted":%d}`, len(records))
+}
+
+// enqueue queues records in the pipeline, and returns the status for the response.
+func (c *Client) enqueue(records []*types.Record) int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.shutdown {
+		return http.StatusServiceUnavailable
+	}
+
+	// Reject the request up front if it can't fit, rather than queueing part of it. Requests larger
+	// than the whole buffer have to wait for space instead.
+	free := cap(c.out) - len(c.out)
+	if free < len(records) && len(records) <= cap(c.out) {
+		return http.StatusTooManyRequests
+	}
+
+	timer := time.NewTimer(c.queueTimeout)
+	defer timer.Stop()
+	for _, record := range records {
+		select {
+		case c.out <- record:
+		case <-timer.C:
+			// Part of the request may have been queued, so retrying it can duplicate records.
+			return http.StatusServiceUnavailable
+		}
+	}
+	return http.StatusOK
+}
+
+var errBodyTooLarge = errors.New("Request body is too large")
+
+// decode reads the records in a request body.
+func (c *Client) decode(r *http.Request) ([]*types.Record, error) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid gzip body")
+		}
+		defer gzipReader.Close()
+		body = gzipReader
+	}
+	// Read one byte past the limit, to detect bodies that are too large.
+	limited := &io.LimitedReader{R: body, N: c.maxBodySize + 1}
+	reader := bufio.NewReader(limited)
+
+	var objects []map[string]interface{}
+	first, err := peekNonSpace(reader)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(reader)
+	if first == '[' {
+		err = decoder.Decode(&objects)
+	} else {
+		for {
+			var object map[string]interface{}
+			if err = decoder.Decode(&object); err != nil {
+				break
+			}
+			objects = append(objects, object)
+		}
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if limited.N <= 0 {
+		return nil, errBodyTooLarge
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid JSON body")
+	}
+
+	records := make([]*types.Record, 0, len(objects))
+	for _, object := range objects {
+		if object == nil {
+			return nil, errors.New("Invalid JSON body: records must be objects")
+		}
+		records = append(records, c.toRecord(object))
+	}
+	return records, nil
+}
+
+func (c *Client) toRecord(fields map[string]interface{}) *types.Record {
+	recordTime := time.Now()
+	// Use the ts field for the time if present, like the json transformer.
+	if ts, ok := fields["ts"].(float64); ok {
+		seconds, subseconds := math.Modf(ts)
+		recordTime = time.Unix(int64(seconds), int64(subseconds*float64(time.Second)))
+	}
+	// Clients retry what wasn't accepted, so records have no cursor to resume from.
+	return &types.Record{
+		Time:   recordTime,
+		Fields: fields,
+	}
+}
+
+// peekNonSpace skips leading whitespace, and returns the first byte of the body without consuming it.
+func peekNonSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return b, reader.UnreadByte()
+		}
+	}
+}
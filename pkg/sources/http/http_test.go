@@ -0,0 +1,123 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+func newTestClient(out chan *types.Record) *Client {
+	return &Client{
+		out:          out,
+		maxBodySize:  1024,
+		queueTimeout: time.Millisecond * 50,
+	}
+}
+
+func post(client *Client, body []byte, gzipped bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/logs", bytes.NewReader(body))
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	recorder := httptest.NewRecorder()
+	client.handle(recorder, req)
+	return recorder
+}
+
+func TestFormats(t *testing.T) {
+	out := make(chan *types.Record, 10)
+	client := newTestClient(out)
+
+	resp := post(client, []byte("{\"log\":\"1\",\"ts\":1500000000.5}\n{\"log\":\"2\"}\n"), false)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for ndjson, but got %d: %s", resp.Code, resp.Body)
+	}
+	record := <-out
+	if record.Fields["log"] != "1" || !record.Time.Equal(time.Unix(1500000000, 500000000)) {
+		t.Errorf("Expected record 1 with time from ts, but got %v at %s", record.Fields, record.Time)
+	}
+	if record := <-out; record.Fields["log"] != "2" {
+		t.Errorf("Expected record 2, but got %v", record.Fields)
+	}
+
+	var compressed bytes.Buffer
+	gzipper := gzip.NewWriter(&compressed)
+	gzipper.Write([]byte(` [{"log":"3"},{"log":"4"}]`))
+	gzipper.Close()
+	resp = post(client, compressed.Bytes(), true)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for gzip'd json array, but got %d: %s", resp.Code, resp.Body)
+	}
+	if len(out) != 2 {
+		t.Fatalf("Expected 2 records to be queued, but got %d", len(out))
+	}
+	<-out
+	<-out
+
+	if resp := post(client, []byte(`{"log":`), false); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid json, but got %d", resp.Code)
+	}
+	if resp := post(client, []byte(`[1, 2]`), false); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for non-object records, but got %d", resp.Code)
+	}
+	large := `{"log":"` + strings.Repeat("a", 2048) + `"}`
+	if resp := post(client, []byte(large), false); resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413 for a large body, but got %d", resp.Code)
+	}
+	if len(out) != 0 {
+		t.Errorf("Expected rejected requests not to queue records, but got %d", len(out))
+	}
+}
+
+func TestBackPressure(t *testing.T) {
+	out := make(chan *types.Record, 2)
+	client := newTestClient(out)
+
+	body := []byte("{\"log\":\"1\"}\n{\"log\":\"2\"}\n")
+	if resp := post(client, body, false); resp.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, but got %d", resp.Code)
+	}
+
+	resp := post(client, body, false)
+	if resp.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429 when the pipeline is full, but got %d", resp.Code)
+	}
+	if resp.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected Retry-After header to be set")
+	}
+
+	// A request larger than the buffer waits for space, and times out.
+	resp = post(client, []byte("{\"log\":\"3\"}\n{\"log\":\"4\"}\n{\"log\":\"5\"}\n"), false)
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status 503 when queueing times out, but got %d", resp.Code)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	client, err := New(Config{Address: "127.0.0.1:0", ReadTimeout: time.Millisecond * 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Start(make(chan *types.Record, 10))
+	defer client.Stop()
+
+	// A client that never finishes its request is disconnected.
+	conn, err := net.Dial("tcp", client.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("POST /logs HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100\r\n\r\n{"))
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Errorf("Expected the connection to be closed, but got %v", err)
+	}
+}
@@ -1,36 +1,185 @@
 package journal
 
 import (
+	"encoding/json"
 	"math/big"
 	"strconv"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/wearefair/log-aggregator/pkg/types"
 )
 
-const SD_JOURNAL_FIELD_SOURCE_REALTIME_TIMESTAMP = "_SOURCE_REALTIME_TIMESTAMP"
+const (
+	SD_JOURNAL_FIELD_SOURCE_REALTIME_TIMESTAMP = "_SOURCE_REALTIME_TIMESTAMP"
+
+	// Fields holding the decoded PRIORITY and SYSLOG_FACILITY, e.g. warning and daemon
+	FieldSeverity = types.FieldSeverity
+	FieldFacility = types.FieldFacility
+	// Field holding the ID of the machine that wrote the entry (e.g. for remote journals)
+	FieldMachineID = "machine_id"
+
+	// Names of the journals in cursors
+	journalSystem          = "system"
+	journalFiles           = "files"
+	journalDirectoryPrefix = "directory:"
+	journalNamespacePrefix = "namespace:"
+)
+
+// StartMode is where reading starts when there is no cursor (or it can't be used).
+type StartMode string
+
+const (
+	// StartHead reads the whole journal
+	StartHead StartMode = "head"
+	// StartTail only reads entries written after starting
+	StartTail StartMode = "tail"
+	// StartBoot reads the entries of the current boot
+	StartBoot StartMode = "boot"
+	// StartSince reads the entries written since ClientConfig.Since
+	StartSince StartMode = "since"
+
+	DefaultStart = StartHead
+)
+
+// DefaultExcludeFields are the journal fields that aren't forwarded, unless configured otherwise.
+var DefaultExcludeFields = []string{
+	"__CURSOR",
+	"__MONOTONIC_TIMESTAMP",
+	"__REALTIME_TIMESTAMP",
+	"_BOOT_ID",
+	"_UID",
+	"_GID",
+	"_CAP_EFFECTIVE",
+	"_SYSTEMD_SLICE",
+	"_SYSTEMD_CGROUP",
+	"_CMDLINE",
+	"_COMM",
+	"_EXE",
+	"_SELINUX_CONTEXT",
+	"_SOURCE_REALTIME_TIMESTAMP",
+	"_TRANSPORT",
+	"_MACHINE_ID",
+	"_HOSTNAME",
+	"SYSLOG_IDENTIFIER",
+	"SYSLOG_FACILITY",
+	"PRIORITY",
+}
 
 type ClientConfig struct {
 	JournalDirectory string
-	Cursor           types.Cursor
+	// JournalDirectories are read in addition to JournalDirectory, e.g. /var/log/journal/remote for
+	// files received by systemd-journal-remote.
+	JournalDirectories []string
+	// JournalFiles are journal files to read.
+	JournalFiles []string
+	// Namespaces are journald namespaces to read, in addition to the other journals. The system journal
+	// is read unless directories or files are configured.
+	Namespaces []string
+	Cursor     types.Cursor
+	// Matches select the entries that are read, e.g. _SYSTEMD_UNIT=docker.service + CONTAINER_NAME PRIORITY<=4
+	// (see parseMatches for the syntax). All entries are read if there are none.
+	Matches []string
+	// IncludeFields, if set, are the only journal fields that are forwarded.
+	IncludeFields []string
+	// Start is where to start reading without a cursor, or when seeking to the cursor fails (e.g. after
+	// the journal was vacuumed or the cursor is from another source).
+	Start StartMode
+	// Since is the time to start reading from with StartSince.
+	Since time.Time
+	// ExcludeFields are journal fields that aren't forwarded. Defaults to DefaultExcludeFields if nil,
+	// set it to an empty list to forward every field.
+	ExcludeFields []string
+}
+
+// ParseStart parses a start mode, or a RFC 3339 timestamp to start reading from.
+func ParseStart(value string) (StartMode, time.Time, error) {
+	switch mode := StartMode(value); mode {
+	case "":
+		return DefaultStart, time.Time{}, nil
+	case StartHead, StartTail, StartBoot:
+		return mode, time.Time{}, nil
+	}
+	since, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", time.Time{}, errors.Errorf("Invalid journal start %s, must be head, tail, boot or a RFC 3339 timestamp", value)
+	}
+	return StartSince, since, nil
+}
+
+// startMode returns the configured start mode, or an error if it is invalid.
+func startMode(conf ClientConfig) (StartMode, error) {
+	switch conf.Start {
+	case "":
+		return DefaultStart, nil
+	case StartHead, StartTail, StartBoot:
+		return conf.Start, nil
+	case StartSince:
+		if conf.Since.IsZero() {
+			return "", errors.New("Journal start mode since requires a time")
+		}
+		return conf.Start, nil
+	}
+	return "", errors.Errorf("Unknown journal start mode %s", conf.Start)
+}
+
+// fieldFilter decides which journal fields are forwarded.
+type fieldFilter struct {
+	include map[string]bool
+	exclude map[string]bool
 }
 
 func (c *Client) Stop() {
 	c.shutdown = true
 }
 
-func entryToRecord(entry *JournalEntry) *types.Record {
+func newFieldFilter(conf ClientConfig) fieldFilter {
+	exclude := conf.ExcludeFields
+	if exclude == nil {
+		exclude = DefaultExcludeFields
+	}
+	filter := fieldFilter{exclude: toSet(exclude)}
+	if len(conf.IncludeFields) != 0 {
+		filter.include = toSet(conf.IncludeFields)
+	}
+	return filter
+}
+
+func (f fieldFilter) keep(field string) bool {
+	if f.include != nil && !f.include[field] {
+		return false
+	}
+	return !f.exclude[field]
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+func entryToRecord(entry *JournalEntry, filter fieldFilter) *types.Record {
 	fields := make(map[string]interface{})
 	entryTime := entryToTime(entry)
 
-	// Remove fields that we don't want to forward
-	for _, field := range omitFields {
-		delete(entry.Fields, field)
+	// Copy the fields that we want to forward to record fields
+	for k := range entry.Fields {
+		if filter.keep(k) {
+			fields[k] = entry.Fields[k]
+		}
 	}
 
-	// Copy entry fields to record fields
-	for k := range entry.Fields {
-		fields[k] = entry.Fields[k]
+	// Decode the syslog fields, whether or not the raw ones are forwarded
+	if severity, ok := decode(entry.Fields["PRIORITY"], types.SeverityNames); ok {
+		fields[FieldSeverity] = severity
+	}
+	if facility, ok := decode(entry.Fields["SYSLOG_FACILITY"], types.FacilityNames); ok {
+		fields[FieldFacility] = facility
+	}
+	if machineID, ok := entry.Fields["_MACHINE_ID"]; ok {
+		fields[FieldMachineID] = machineID
 	}
 
 	return &types.Record{
@@ -40,6 +189,47 @@ func entryToRecord(entry *JournalEntry) *types.Record {
 	}
 }
 
+// encodeCursor combines the cursors of the journals that are read, by journal name. A single journal
+// uses its own cursor, which keeps cursors compatible with older versions.
+func encodeCursor(cursors map[string]string, journals int) types.Cursor {
+	if journals == 1 {
+		for _, cursor := range cursors {
+			return types.Cursor(cursor)
+		}
+		return ""
+	}
+	data, _ := json.Marshal(cursors)
+	return types.Cursor(data)
+}
+
+// decodeCursor splits a cursor from encodeCursor into the cursors of the named journals. The cursor
+// of a single journal is the journal cursor itself, which is the cursor of the system journal when
+// journals are added to a deployment that only read the system journal.
+func decodeCursor(cursor types.Cursor, names []string) (map[string]string, error) {
+	var cursors map[string]string
+	if err := json.Unmarshal([]byte(cursor), &cursors); err == nil {
+		return cursors, nil
+	}
+	if len(names) == 1 {
+		return map[string]string{names[0]: string(cursor)}, nil
+	}
+	for _, name := range names {
+		if name == journalSystem {
+			return map[string]string{journalSystem: string(cursor)}, nil
+		}
+	}
+	return nil, errors.Errorf("Invalid cursor for several journals %s", cursor)
+}
+
+// decode returns the name for a numeric field value.
+func decode(value string, names []string) (string, bool) {
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 || i >= len(names) {
+		return "", false
+	}
+	return names[i], true
+}
+
 func entryToTime(entry *JournalEntry) time.Time {
 	if sourceTimestamp, ok := entry.Fields[SD_JOURNAL_FIELD_SOURCE_REALTIME_TIMESTAMP]; ok {
 		secondsStr := sourceTimestamp[0 : len(sourceTimestamp)-6]
@@ -2,10 +2,6 @@ package journal
 
 import "github.com/wearefair/log-aggregator/pkg/types"
 
-var omitFields = []string{
-	SD_JOURNAL_FIELD_SOURCE_REALTIME_TIMESTAMP,
-}
-
 type JournalEntry struct {
 	Fields             map[string]string
 	Cursor             string
@@ -19,6 +15,12 @@ type Client struct {
 }
 
 func New(conf ClientConfig) (*Client, error) {
+	if _, err := parseMatches(conf.Matches); err != nil {
+		return nil, err
+	}
+	if _, err := startMode(conf); err != nil {
+		return nil, err
+	}
 	return &Client{}, nil
 }
 
@@ -3,6 +3,10 @@
 package journal
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/cenkalti/backoff"
@@ -10,107 +14,354 @@ import (
 	"github.com/pkg/errors"
 	"github.com/wearefair/log-aggregator/pkg/logging"
 	"github.com/wearefair/log-aggregator/pkg/types"
+	"go.uber.org/zap"
 )
 
-type JournalEntry sdjournal.JournalEntry
+const (
+	// The ID of the current boot, which identifies its entries in the _BOOT_ID field (without the dashes)
+	bootIDPath = "/proc/sys/kernel/random/boot_id"
+	// The ID of this machine, which names the directories of journal namespaces
+	machineIDPath = "/etc/machine-id"
 
-// Fields to strip from the entry prior to sending out as a record.
-var omitFields = []string{
-	sdjournal.SD_JOURNAL_FIELD_CURSOR,
-	sdjournal.SD_JOURNAL_FIELD_MONOTONIC_TIMESTAMP,
-	sdjournal.SD_JOURNAL_FIELD_BOOT_ID,
-	sdjournal.SD_JOURNAL_FIELD_UID,
-	sdjournal.SD_JOURNAL_FIELD_GID,
-	sdjournal.SD_JOURNAL_FIELD_CAP_EFFECTIVE,
-	sdjournal.SD_JOURNAL_FIELD_SYSTEMD_SLICE,
-	sdjournal.SD_JOURNAL_FIELD_SYSLOG_IDENTIFIER,
-	sdjournal.SD_JOURNAL_FIELD_SYSTEMD_CGROUP,
-	sdjournal.SD_JOURNAL_FIELD_CMDLINE,
-	sdjournal.SD_JOURNAL_FIELD_COMM,
-	sdjournal.SD_JOURNAL_FIELD_SELINUX_CONTEXT,
-	sdjournal.SD_JOURNAL_FIELD_SYSLOG_FACILITY,
-	sdjournal.SD_JOURNAL_FIELD_REALTIME_TIMESTAMP,
-	sdjournal.SD_JOURNAL_FIELD_SOURCE_REALTIME_TIMESTAMP,
-	sdjournal.SD_JOURNAL_FIELD_PRIORITY,
-	sdjournal.SD_JOURNAL_FIELD_TRANSPORT,
-	sdjournal.SD_JOURNAL_FIELD_MACHINE_ID,
-	sdjournal.SD_JOURNAL_FIELD_EXE,
-	sdjournal.SD_JOURNAL_FIELD_HOSTNAME,
-}
+	waitTimeout = time.Second * 5
+)
+
+type JournalEntry sdjournal.JournalEntry
 
 type Client struct {
 	shutdown bool
 	out      chan<- *types.Record
-	journal  *sdjournal.Journal
+	journals []*journalReader
+	matches  matchGroups
+	fields   fieldFilter
+}
+
+// journalReader reads one of the journals, and holds the next entry until it is the oldest one.
+type journalReader struct {
+	name    string
+	journal *sdjournal.Journal
+	// The cursor of the last entry that was sent
+	cursor string
+	next   *sdjournal.JournalEntry
 }
 
 func New(conf ClientConfig) (client *Client, err error) {
-	var journal *sdjournal.Journal
-	if conf.JournalDirectory == "" {
-		journal, err = sdjournal.NewJournal()
-	} else {
-		journal, err = sdjournal.NewJournalFromDir(conf.JournalDirectory)
+	matches, err := parseMatches(conf.Matches)
+	if err != nil {
+		return nil, err
 	}
+	start, err := startMode(conf)
 	if err != nil {
-		return nil, errors.Wrap(err, "Error constructing systemd Journal client")
+		return nil, err
 	}
 
+	journals, err := openJournals(conf)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(journals))
+	for i, reader := range journals {
+		names[i] = reader.name
+	}
+	var cursors map[string]string
 	if string(conf.Cursor) != "" {
-		err = journal.SeekCursor(string(conf.Cursor))
-		if err != nil {
-			return nil, errors.Wrapf(err, "Error seeking to cursor %s", conf.Cursor)
+		if cursors, err = decodeCursor(conf.Cursor, names); err != nil {
+			logging.Logger.Warn("Can't resume from the cursor, starting from the start position instead",
+				zap.String("start", string(start)), zap.Error(err))
 		}
-		// The cursor positions us on the previously read item, so advance to the next one (if possible).
-		_, err = journal.Next()
-		if err != nil {
-			return nil, errors.Wrap(err, "Error advancing to next entry after seeking to cursor")
+	}
+
+	for _, reader := range journals {
+		if err = addMatches(reader.journal, matches); err != nil {
+			return nil, err
+		}
+		if cursor, ok := cursors[reader.name]; ok {
+			if err = seekCursor(reader.journal, cursor); err == nil {
+				reader.cursor = cursor
+				continue
+			}
+			logging.Logger.Warn("Can't resume from the cursor, starting from the start position instead",
+				zap.String("journal", reader.name), zap.String("start", string(start)), zap.Error(err))
+		}
+		if err = seekStart(reader.journal, start, conf.Since, matches); err != nil {
+			return nil, err
 		}
 	}
 	return &Client{
-		journal: journal,
+		journals: journals,
+		matches:  matches,
+		fields:   newFieldFilter(conf),
 	}, nil
 }
 
+// openJournals opens the configured journals, or the system journal if there are none.
+func openJournals(conf ClientConfig) ([]*journalReader, error) {
+	var journals []*journalReader
+	open := func(name string, journal *sdjournal.Journal, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "Error constructing systemd Journal client for %s", name)
+		}
+		journals = append(journals, &journalReader{name: name, journal: journal})
+		return nil
+	}
+
+	directories := conf.JournalDirectories
+	if conf.JournalDirectory != "" {
+		directories = append([]string{conf.JournalDirectory}, directories...)
+	}
+	if len(directories) == 0 && len(conf.JournalFiles) == 0 {
+		journal, err := sdjournal.NewJournal()
+		if err := open(journalSystem, journal, err); err != nil {
+			return nil, err
+		}
+	}
+	for _, directory := range directories {
+		journal, err := sdjournal.NewJournalFromDir(directory)
+		if err := open(journalDirectoryPrefix+directory, journal, err); err != nil {
+			return nil, err
+		}
+	}
+	if len(conf.JournalFiles) != 0 {
+		journal, err := sdjournal.NewJournalFromFiles(conf.JournalFiles...)
+		if err := open(journalFiles, journal, err); err != nil {
+			return nil, err
+		}
+	}
+	for _, namespace := range conf.Namespaces {
+		directory, err := namespaceDirectory(namespace)
+		if err != nil {
+			return nil, err
+		}
+		journal, err := sdjournal.NewJournalFromDir(directory)
+		if err := open(journalNamespacePrefix+namespace, journal, err); err != nil {
+			return nil, err
+		}
+	}
+	return journals, nil
+}
+
+// namespaceDirectory returns the directory journald writes a namespace to, persistent or volatile.
+func namespaceDirectory(namespace string) (string, error) {
+	data, err := ioutil.ReadFile(machineIDPath)
+	if err != nil {
+		return "", errors.Wrap(err, "Error reading machine ID")
+	}
+	name := strings.TrimSpace(string(data)) + "." + namespace
+	for _, root := range []string{"/var/log/journal", "/run/log/journal"} {
+		directory := filepath.Join(root, name)
+		if _, err := os.Stat(directory); err == nil {
+			return directory, nil
+		}
+	}
+	return "", errors.Errorf("No journal directory found for namespace %s", namespace)
+}
+
+// seekCursor positions the journal on the entry of the cursor, so that reading continues after it.
+func seekCursor(journal *sdjournal.Journal, cursor string) error {
+	if err := journal.SeekCursor(cursor); err != nil {
+		return errors.Wrapf(err, "Error seeking to cursor %s", cursor)
+	}
+	// The cursor positions us before the previously read item, so advance to it (if possible).
+	if _, err := journal.Next(); err != nil {
+		return errors.Wrap(err, "Error advancing to next entry after seeking to cursor")
+	}
+	// If the entry was vacuumed, the journal is on the closest entry after it instead, which hasn't
+	// been read yet, so step back before it. At the head of the journal there is no entry before
+	// it to step back to, so seek to the head instead.
+	if journal.TestCursor(cursor) != nil {
+		moved, err := journal.Previous()
+		if err != nil {
+			return errors.Wrap(err, "Error stepping back after seeking to a missing cursor")
+		}
+		if moved == 0 {
+			if err := journal.SeekHead(); err != nil {
+				return errors.Wrap(err, "Error seeking to head after seeking to a missing cursor")
+			}
+		}
+	}
+	return nil
+}
+
+// seekStart positions the journal before the first entry to read for a start mode.
+func seekStart(journal *sdjournal.Journal, start StartMode, since time.Time, matches matchGroups) error {
+	var err error
+	switch start {
+	case StartHead:
+		err = journal.SeekHead()
+	case StartTail:
+		// The tail is after the last entry, which Next doesn't return until stepping back to it.
+		if err = journal.SeekTail(); err == nil {
+			_, err = journal.Previous()
+		}
+	case StartSince:
+		err = journal.SeekRealtimeUsec(uint64(since.UnixNano() / int64(time.Microsecond)))
+	case StartBoot:
+		err = seekBoot(journal, matches)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Error seeking systemd Journal to start position %s", start)
+	}
+	return nil
+}
+
+// seekBoot seeks to the time of the first entry of the current boot. The entry is found with a
+// _BOOT_ID match, which is replaced by the configured matches again afterwards.
+func seekBoot(journal *sdjournal.Journal, matches matchGroups) error {
+	data, err := ioutil.ReadFile(bootIDPath)
+	if err != nil {
+		return errors.Wrap(err, "Error reading boot ID")
+	}
+	bootID := strings.Replace(strings.TrimSpace(string(data)), "-", "", -1)
+
+	journal.FlushMatches()
+	if err := journal.AddMatch(sdjournal.SD_JOURNAL_FIELD_BOOT_ID + "=" + bootID); err != nil {
+		return errors.Wrap(err, "Error adding boot ID match")
+	}
+	if err := journal.SeekHead(); err != nil {
+		return err
+	}
+	count, err := journal.Next()
+	if err != nil {
+		return err
+	}
+	var usec uint64
+	if count != 0 {
+		if usec, err = journal.GetRealtimeUsec(); err != nil {
+			return err
+		}
+	}
+
+	journal.FlushMatches()
+	if err := addMatches(journal, matches); err != nil {
+		return err
+	}
+	if count == 0 {
+		// Nothing has been logged in this boot yet
+		if err := journal.SeekTail(); err != nil {
+			return err
+		}
+		_, err = journal.Previous()
+		return err
+	}
+	return journal.SeekRealtimeUsec(usec)
+}
+
+// addMatches adds the matches to the journal, so that other entries are skipped before being read.
+func addMatches(journal *sdjournal.Journal, matches matchGroups) error {
+	for i, group := range matches.journalMatches() {
+		if i > 0 {
+			if err := journal.AddDisjunction(); err != nil {
+				return errors.Wrap(err, "Error adding disjunction to systemd Journal matches")
+			}
+		}
+		for _, match := range group {
+			if err := journal.AddMatch(match); err != nil {
+				return errors.Wrapf(err, "Error adding systemd Journal match %s", match)
+			}
+		}
+	}
+	return nil
+}
+
 func (c *Client) Start(out chan<- *types.Record) {
 	c.out = out
 	go c.read()
 }
 
 func (c *Client) read() {
-	var entry *sdjournal.JournalEntry
-	var count uint64
-	var err error
-
 	for !c.shutdown {
-		// If the error is not nil from the previous run, sleep for half a second
+		reader, err := c.oldest()
 		if err != nil {
+			logging.Error(err)
+			// Sleep for half a second before retrying
 			time.Sleep(time.Millisecond * 500)
+			continue
 		}
-		count, err = c.journal.Next()
-		if err != nil {
-			logging.Error(errors.Wrap(err, "Got error advancing entry from systemd Journal"))
+		if reader == nil {
+			c.wait()
 			continue
 		}
+
+		entry := reader.next
+		reader.next = nil
+		reader.cursor = entry.Cursor
+		record := entryToRecord((*JournalEntry)(entry), c.fields)
+		record.Cursor = c.cursor()
+		c.out <- record
+	}
+}
+
+// oldest reads ahead in every journal, and returns the one with the oldest entry (or nil if there are
+// no new entries), so that entries of several journals are sent in order.
+func (c *Client) oldest() (*journalReader, error) {
+	var oldest *journalReader
+	for _, reader := range c.journals {
+		if err := c.readNext(reader); err != nil {
+			return nil, err
+		}
+		if reader.next != nil && (oldest == nil || reader.next.RealtimeTimestamp < oldest.next.RealtimeTimestamp) {
+			oldest = reader
+		}
+	}
+	return oldest, nil
+}
+
+// readNext reads the next matching entry of a journal, if it doesn't have one already.
+func (c *Client) readNext(reader *journalReader) error {
+	for reader.next == nil {
+		count, err := reader.journal.Next()
+		if err != nil {
+			return errors.Wrapf(err, "Got error advancing entry from systemd Journal %s", reader.name)
+		}
 		if count == 0 {
-			// Wait for new journal events
-			c.journal.Wait(time.Second * 5)
+			return nil
+		}
+		// Field presence isn't a journal match, so check it before reading the whole entry.
+		if c.matches.needsCheck() && !c.matches.matches(reader.fieldValue) {
 			continue
 		}
 		// If reading the entry fails (we have already retried)
 		// then panic, as there is no way to recover
-		entry, err = c.readEntry()
+		entry, err := readEntry(reader.journal)
 		if err != nil {
 			logging.Error(err)
 			panic(err)
 		}
+		reader.next = entry
+	}
+	return nil
+}
 
-		c.out <- entryToRecord((*JournalEntry)(entry))
+// wait waits for new journal events, sharing the timeout between the journals.
+func (c *Client) wait() {
+	timeout := waitTimeout / time.Duration(len(c.journals))
+	for _, reader := range c.journals {
+		if reader.journal.Wait(timeout) != sdjournal.SD_JOURNAL_NOP {
+			return
+		}
 	}
 }
 
-func (c *Client) readEntry() (entry *sdjournal.JournalEntry, err error) {
+// cursor returns the position of every journal, after the entries that were sent.
+func (c *Client) cursor() types.Cursor {
+	cursors := make(map[string]string, len(c.journals))
+	for _, reader := range c.journals {
+		if reader.cursor != "" {
+			cursors[reader.name] = reader.cursor
+		}
+	}
+	return encodeCursor(cursors, len(c.journals))
+}
+
+// fieldValue reads a single field of the current entry.
+func (r *journalReader) fieldValue(field string) (string, bool) {
+	value, err := r.journal.GetDataValue(field)
+	return value, err == nil
+}
+
+func readEntry(journal *sdjournal.Journal) (entry *sdjournal.JournalEntry, err error) {
 	readHelper := func() error {
-		entry, err = c.journal.GetEntry()
+		entry, err = journal.GetEntry()
 		return err
 	}
 	// Call once before setting up retry logic
@@ -1,7 +1,10 @@
 package journal
 
 import (
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/wearefair/log-aggregator/pkg/types"
 )
@@ -12,10 +15,11 @@ func TestEntryToRecord(t *testing.T) {
 		Fields: map[string]string{
 			"_SOURCE_REALTIME_TIMESTAMP": "abcdefghejgjslfk",
 			"MY_FIELD":                   "foobar",
+			"_MACHINE_ID":                "0123456789abcdef",
 		},
 		Cursor: "mycursor",
 	}
-	record := entryToRecord(entry)
+	record := entryToRecord(entry, newFieldFilter(ClientConfig{}))
 
 	if record.Cursor != types.Cursor("mycursor") {
 		t.Errorf("Expected cursor to be mycursor, but got %s", record.Cursor)
@@ -33,6 +37,60 @@ func TestEntryToRecord(t *testing.T) {
 	if val, ok := record.Fields["MY_FIELD"]; !ok || val != "foobar" {
 		t.Errorf("Expected field MY_FIELD to be foobar, but got '%s'", val)
 	}
+
+	if val := record.Fields[FieldMachineID]; val != "0123456789abcdef" {
+		t.Errorf("Expected field %s to be 0123456789abcdef, but got '%v'", FieldMachineID, val)
+	}
+}
+
+func TestFieldFilter(t *testing.T) {
+	entry := &JournalEntry{
+		Fields: map[string]string{
+			"MESSAGE":           "foobar",
+			"PRIORITY":          "4",
+			"SYSLOG_FACILITY":   "3",
+			"SYSLOG_IDENTIFIER": "dockerd",
+			"_HOSTNAME":         "ip-10-0-0-1",
+		},
+	}
+
+	record := entryToRecord(entry, newFieldFilter(ClientConfig{}))
+	expected := map[string]interface{}{
+		"MESSAGE":     "foobar",
+		FieldSeverity: "warning",
+		FieldFacility: "daemon",
+	}
+	if !reflect.DeepEqual(record.Fields, expected) {
+		t.Errorf("Expected fields %v by default, but got %v", expected, record.Fields)
+	}
+
+	record = entryToRecord(entry, newFieldFilter(ClientConfig{ExcludeFields: []string{"_HOSTNAME"}}))
+	if record.Fields["PRIORITY"] != "4" || record.Fields["SYSLOG_IDENTIFIER"] != "dockerd" {
+		t.Errorf("Expected fields that aren't excluded to be kept, but got %v", record.Fields)
+	}
+	if _, ok := record.Fields["_HOSTNAME"]; ok {
+		t.Errorf("Expected field _HOSTNAME to be excluded")
+	}
+
+	record = entryToRecord(entry, newFieldFilter(ClientConfig{
+		IncludeFields: []string{"MESSAGE", "_HOSTNAME"},
+		ExcludeFields: []string{},
+	}))
+	expected = map[string]interface{}{
+		"MESSAGE":     "foobar",
+		"_HOSTNAME":   "ip-10-0-0-1",
+		FieldSeverity: "warning",
+		FieldFacility: "daemon",
+	}
+	if !reflect.DeepEqual(record.Fields, expected) {
+		t.Errorf("Expected only included fields %v, but got %v", expected, record.Fields)
+	}
+
+	entry.Fields["PRIORITY"] = "9"
+	record = entryToRecord(entry, newFieldFilter(ClientConfig{}))
+	if _, ok := record.Fields[FieldSeverity]; ok {
+		t.Errorf("Did not expect a severity for an invalid priority")
+	}
 }
 
 func TestEntryToTime(t *testing.T) {
@@ -74,3 +132,124 @@ func TestEntryToTime(t *testing.T) {
 			entryTime.Unix(), entryTime.Nanosecond())
 	}
 }
+
+func TestParseMatches(t *testing.T) {
+	matches, err := parseMatches(strings.Fields("_SYSTEMD_UNIT=docker.service _SYSTEMD_UNIT=kubelet.service + CONTAINER_NAME PRIORITY<=warning"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"_SYSTEMD_UNIT=docker.service", "_SYSTEMD_UNIT=kubelet.service"},
+		{"PRIORITY=0", "PRIORITY=1", "PRIORITY=2", "PRIORITY=3", "PRIORITY=4"},
+	}
+	if actual := matches.journalMatches(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected journal matches %v, but got %v", expected, actual)
+	}
+	if !matches.needsCheck() {
+		t.Errorf("Expected field presence to be checked")
+	}
+
+	// A group that only checks presence can't be filtered by the journal.
+	matches, err = parseMatches([]string{"_SYSTEMD_UNIT=docker.service", "+", "CONTAINER_NAME"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := matches.journalMatches(); actual != nil {
+		t.Errorf("Expected no journal matches, but got %v", actual)
+	}
+
+	for _, invalid := range []string{"+", "A=1 +", "lower=1", "UNIT<=3", "PRIORITY<=8", "PRIORITY<=loud"} {
+		if _, err := parseMatches(strings.Fields(invalid)); err == nil {
+			t.Errorf("Expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	matches, err := parseMatches(strings.Fields("_SYSTEMD_UNIT=docker.service + CONTAINER_NAME PRIORITY<=3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		fields   map[string]string
+		expected bool
+	}{
+		{map[string]string{"_SYSTEMD_UNIT": "docker.service"}, true},
+		{map[string]string{"_SYSTEMD_UNIT": "sshd.service", "PRIORITY": "3"}, false},
+		{map[string]string{"CONTAINER_NAME": "web", "PRIORITY": "3"}, true},
+		{map[string]string{"CONTAINER_NAME": "web", "PRIORITY": "6"}, false},
+	}
+	for _, test := range tests {
+		value := func(field string) (string, bool) {
+			v, ok := test.fields[field]
+			return v, ok
+		}
+		if actual := matches.matches(value); actual != test.expected {
+			t.Errorf("Expected %v to match %v, but got %v", test.fields, test.expected, actual)
+		}
+	}
+
+	if !matchGroups(nil).matches(func(string) (string, bool) { return "", false }) {
+		t.Errorf("Expected every entry to match without matches")
+	}
+}
+
+func TestParseStart(t *testing.T) {
+	for value, expected := range map[string]StartMode{"": DefaultStart, "head": StartHead, "tail": StartTail, "boot": StartBoot} {
+		if mode, _, err := ParseStart(value); err != nil || mode != expected {
+			t.Errorf("Expected %s to parse as %s, but got %s (%v)", value, expected, mode, err)
+		}
+	}
+
+	mode, since, err := ParseStart("2019-11-04T12:30:00Z")
+	if err != nil || mode != StartSince || !since.Equal(time.Date(2019, 11, 4, 12, 30, 0, 0, time.UTC)) {
+		t.Errorf("Expected a timestamp to parse as since, but got %s %s (%v)", mode, since, err)
+	}
+	if _, err := startMode(ClientConfig{Start: mode, Since: since}); err != nil {
+		t.Errorf("Expected a valid start mode, but got %v", err)
+	}
+
+	if _, _, err := ParseStart("yesterday"); err == nil {
+		t.Errorf("Expected an error for an invalid start")
+	}
+	if _, err := startMode(ClientConfig{Start: StartSince}); err == nil {
+		t.Errorf("Expected an error for since without a time")
+	}
+}
+
+func TestCursor(t *testing.T) {
+	// A single journal keeps its own cursor format.
+	cursor := encodeCursor(map[string]string{journalSystem: "s=abc;i=1"}, 1)
+	if cursor != "s=abc;i=1" {
+		t.Errorf("Expected the journal cursor, but got %s", cursor)
+	}
+	cursors, err := decodeCursor(cursor, []string{journalSystem})
+	if err != nil || cursors[journalSystem] != "s=abc;i=1" {
+		t.Errorf("Expected the journal cursor, but got %v (%v)", cursors, err)
+	}
+
+	names := []string{journalSystem, journalNamespacePrefix + "noisy"}
+	expected := map[string]string{journalSystem: "s=abc;i=1", journalNamespacePrefix + "noisy": "s=def;i=2"}
+	cursors, err = decodeCursor(encodeCursor(expected, len(names)), names)
+	if err != nil || !reflect.DeepEqual(cursors, expected) {
+		t.Errorf("Expected cursors %v, but got %v (%v)", expected, cursors, err)
+	}
+
+	// Journals that are added resume the system journal from its single journal cursor.
+	cursors, err = decodeCursor("s=abc;i=1", names)
+	if err != nil || !reflect.DeepEqual(cursors, map[string]string{journalSystem: "s=abc;i=1"}) {
+		t.Errorf("Expected the system journal cursor, but got %v (%v)", cursors, err)
+	}
+	if _, err := decodeCursor("s=abc;i=1", names[1:2]); err != nil {
+		t.Errorf("Expected a single journal to use the journal cursor, but got %v", err)
+	}
+	if _, err := decodeCursor("s=abc;i=1", []string{journalFiles, journalNamespacePrefix + "noisy"}); err == nil {
+		t.Errorf("Expected an error for a single journal cursor without the system journal")
+	}
+
+	// Going back to a single journal resumes it from its cursor.
+	cursors, err = decodeCursor(encodeCursor(expected, len(names)), names[:1])
+	if err != nil || cursors[journalSystem] != "s=abc;i=1" {
+		t.Errorf("Expected the system journal cursor, but got %v (%v)", cursors, err)
+	}
+}
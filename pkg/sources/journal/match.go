@@ -0,0 +1,190 @@
+package journal
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+const (
+	fieldPriority = "PRIORITY"
+	// Separates groups of match terms, like it does for journalctl
+	matchDisjunction = "+"
+)
+
+// matchTerm matches entries where the field has one of the values, or has any value if values is nil.
+type matchTerm struct {
+	field  string
+	values []string
+}
+
+// matchGroup matches entries that match all of its terms.
+type matchGroup []matchTerm
+
+// matchGroups match entries that match any of the groups.
+type matchGroups []matchGroup
+
+// parseMatches parses match terms with the syntax of journalctl's match arguments:
+//   - FIELD=value matches entries where the field has the value
+//   - FIELD matches entries that have the field, with any value
+//   - PRIORITY<=level matches entries at least as severe as the level (0-7, or a name like warning)
+//   - + separates groups of terms
+//
+// Entries match if they match all the terms of any group. Like journalctl, terms for the same field
+// within a group match any of their values.
+func parseMatches(matches []string) (matchGroups, error) {
+	var groups matchGroups
+	var group matchGroup
+	for _, match := range matches {
+		if match == matchDisjunction {
+			if len(group) == 0 {
+				return nil, errors.New("Journal match groups separated by + can't be empty")
+			}
+			groups = append(groups, group)
+			group = nil
+			continue
+		}
+		term, err := parseMatch(match)
+		if err != nil {
+			return nil, err
+		}
+		group = group.add(term)
+	}
+	if len(group) == 0 {
+		if len(groups) != 0 {
+			return nil, errors.New("Journal match groups separated by + can't be empty")
+		}
+		return nil, nil
+	}
+	return append(groups, group), nil
+}
+
+func parseMatch(match string) (matchTerm, error) {
+	if i := strings.Index(match, "<="); i >= 0 {
+		if match[:i] != fieldPriority {
+			return matchTerm{}, errors.Errorf("Invalid journal match %s, only %s supports <=", match, fieldPriority)
+		}
+		level := indexOf(types.SeverityNames, match[i+2:])
+		if level < 0 {
+			var err error
+			level, err = strconv.Atoi(match[i+2:])
+			if err != nil || level < 0 || level >= len(types.SeverityNames) {
+				return matchTerm{}, errors.Errorf("Invalid priority in journal match %s", match)
+			}
+		}
+		term := matchTerm{field: fieldPriority}
+		for priority := 0; priority <= level; priority++ {
+			term.values = append(term.values, strconv.Itoa(priority))
+		}
+		return term, nil
+	}
+
+	term := matchTerm{field: match}
+	if i := strings.Index(match, "="); i >= 0 {
+		term = matchTerm{field: match[:i], values: []string{match[i+1:]}}
+	}
+	if !validField(term.field) {
+		return matchTerm{}, errors.Errorf("Invalid field name in journal match %s", match)
+	}
+	return term, nil
+}
+
+// validField checks that a field name is one journald accepts: upper case letters, digits and
+// underscores, not starting with a digit.
+func validField(field string) bool {
+	if field == "" || (field[0] >= '0' && field[0] <= '9') {
+		return false
+	}
+	for _, r := range field {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// add merges the term with an existing term for the same field.
+func (g matchGroup) add(term matchTerm) matchGroup {
+	for i := range g {
+		if g[i].field != term.field {
+			continue
+		}
+		if g[i].values == nil || term.values == nil {
+			g[i].values = nil
+		} else {
+			g[i].values = append(g[i].values, term.values...)
+		}
+		return g
+	}
+	return append(g, term)
+}
+
+// journalMatches returns the FIELD=value matches of each group, to add to the journal. Field presence
+// can't be expressed as a journald match, so nil is returned if any group only checks presence, as
+// the journal can't filter that group's entries at all.
+func (groups matchGroups) journalMatches() [][]string {
+	var matches [][]string
+	for _, group := range groups {
+		var groupMatches []string
+		for _, term := range group {
+			for _, value := range term.values {
+				groupMatches = append(groupMatches, term.field+"="+value)
+			}
+		}
+		if len(groupMatches) == 0 {
+			return nil
+		}
+		matches = append(matches, groupMatches)
+	}
+	return matches
+}
+
+// needsCheck reports if entries returned by the journal have to be checked with matches, because
+// field presence is used.
+func (groups matchGroups) needsCheck() bool {
+	for _, group := range groups {
+		for _, term := range group {
+			if term.values == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matches checks an entry, given a function that returns the value of one of its fields.
+func (groups matchGroups) matches(value func(field string) (string, bool)) bool {
+	if len(groups) == 0 {
+		return true
+	}
+	for _, group := range groups {
+		if group.matches(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g matchGroup) matches(value func(field string) (string, bool)) bool {
+	for _, term := range g {
+		actual, ok := value(term.field)
+		if !ok {
+			return false
+		}
+		if term.values != nil && indexOf(term.values, actual) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
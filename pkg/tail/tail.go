@@ -0,0 +1,372 @@
+// Package tail follows the files matching a glob pattern, and hands their lines to a Handler.
+//
+// New files are picked up when the pattern is rescanned. Files that are replaced (rotated) or
+// truncated are read to the end and reopened, and files that are removed are read to the end and
+// closed. Lines longer than the max line size are truncated.
+//
+// Cursors are snapshots of the read positions of all files. Snapshots are taken periodically, and
+// only include lines that were completely handled, so resuming from the cursor of any line can
+// repeat lines, but never skips them.
+package tail
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/logging"
+	"github.com/wearefair/log-aggregator/pkg/types"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultPollInterval   = time.Millisecond * 250
+	DefaultRescanInterval = time.Second * 5
+	DefaultCursorInterval = time.Second * 1
+	DefaultMaxLineSize    = 1024 * 1024
+)
+
+type Config struct {
+	// Pattern is the glob pattern of the files to follow.
+	Pattern string
+	Cursor  types.Cursor
+	// ReadFromHead reads files that already exist on the first start (without a cursor) from the
+	// beginning, instead of only reading new lines.
+	ReadFromHead bool
+	// PollInterval is how often files are checked for new lines.
+	PollInterval time.Duration
+	// RescanInterval is how often the pattern is checked for new (and rotated) files.
+	RescanInterval time.Duration
+	// CursorInterval is how often a snapshot of the read positions is taken.
+	CursorInterval time.Duration
+	// MaxLineSize is the longest line that is handed to the handler, the rest of a longer line is
+	// skipped.
+	MaxLineSize int
+}
+
+// Handler creates a LineHandler for every file that is opened.
+type Handler interface {
+	// Open is called when a file is opened. Files that return an error are skipped.
+	Open(path string) (LineHandler, error)
+}
+
+// LineHandler processes the lines of a single file.
+type LineHandler interface {
+	// Line handles a complete line (including the newline), and returns whether every line up to it
+	// has been handled completely, i.e. it's false while a partial message is pending. Truncated
+	// lines, and the unterminated last line of a file that is closed, have no newline.
+	Line(line []byte, cursor types.Cursor) bool
+	// Close is called when the file is closed after it was rotated or removed, to flush any pending
+	// partial message.
+	Close(cursor types.Cursor)
+}
+
+type Tailer struct {
+	pattern        string
+	handler        Handler
+	pollInterval   time.Duration
+	rescanInterval time.Duration
+	cursorInterval time.Duration
+	maxLineSize    int
+
+	files map[string]*file
+	// Positions from the cursor, for files that haven't been opened yet.
+	positions map[string]position
+	// Whether files found on the first scan are read from the beginning.
+	readFromHead bool
+	scanned      bool
+	cursor       types.Cursor
+	cursorAt     time.Time
+	scannedAt    time.Time
+}
+
+// position is the read position of a file, as stored in the cursor.
+type position struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+type file struct {
+	path    string
+	file    *os.File
+	reader  *bufio.Reader
+	handler LineHandler
+	inode   uint64
+	// Offset of the end of the last complete line that was read.
+	offset int64
+	// Offset up to which every line has been handled completely.
+	committed int64
+	// A line that has been read up to the end of the file, but isn't terminated yet, and its size
+	// before it was truncated.
+	pending     []byte
+	pendingSize int64
+}
+
+func New(conf Config, handler Handler) *Tailer {
+	tailer := &Tailer{
+		pattern:        conf.Pattern,
+		handler:        handler,
+		pollInterval:   conf.PollInterval,
+		rescanInterval: conf.RescanInterval,
+		cursorInterval: conf.CursorInterval,
+		maxLineSize:    conf.MaxLineSize,
+		files:          make(map[string]*file),
+		positions:      make(map[string]position),
+		readFromHead:   conf.ReadFromHead,
+	}
+	if tailer.pollInterval == time.Duration(0) {
+		tailer.pollInterval = DefaultPollInterval
+	}
+	if tailer.rescanInterval == time.Duration(0) {
+		tailer.rescanInterval = DefaultRescanInterval
+	}
+	if tailer.cursorInterval == time.Duration(0) {
+		tailer.cursorInterval = DefaultCursorInterval
+	}
+	if tailer.maxLineSize == 0 {
+		tailer.maxLineSize = DefaultMaxLineSize
+	}
+
+	if string(conf.Cursor) != "" {
+		if err := json.Unmarshal([]byte(conf.Cursor), &tailer.positions); err != nil {
+			// Most likely a cursor of a different source, so start over.
+			logging.Error(errors.Wrapf(err, "Ignoring invalid cursor %s", conf.Cursor))
+		} else {
+			// Files that aren't in the cursor were created while we weren't running.
+			tailer.readFromHead = true
+		}
+	}
+	return tailer
+}
+
+// Run follows the files until stop is closed.
+func (t *Tailer) Run(stop <-chan struct{}) {
+	defer t.closeAll()
+	for {
+		read := t.Poll(time.Now())
+		if read {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			continue
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(t.pollInterval):
+		}
+	}
+}
+
+// Poll rescans the pattern and takes a cursor snapshot if they're due, and reads new lines from
+// every file. It returns whether any lines were read.
+func (t *Tailer) Poll(now time.Time) bool {
+	if !t.scanned || now.Sub(t.scannedAt) >= t.rescanInterval {
+		t.scan()
+		t.scannedAt = now
+	}
+	if t.cursor == "" || now.Sub(t.cursorAt) >= t.cursorInterval {
+		t.snapshot()
+		t.cursorAt = now
+	}
+
+	read := false
+	for _, f := range t.files {
+		if t.readLines(f) {
+			read = true
+		}
+	}
+	return read
+}
+
+// scan opens new files, reopens rotated ones, and closes removed ones.
+func (t *Tailer) scan() {
+	matches, err := filepath.Glob(t.pattern)
+	if err != nil {
+		logging.Error(errors.Wrapf(err, "Error listing files matching %s", t.pattern))
+		return
+	}
+
+	found := make(map[string]bool, len(matches))
+	for _, path := range matches {
+		found[path] = true
+		f, ok := t.files[path]
+		if !ok {
+			t.open(path, t.startOffset(path))
+			continue
+		}
+		if t.rotated(f) {
+			// Finish reading the old file, and read the new one from the beginning.
+			t.readLines(f)
+			t.close(f)
+			t.open(path, 0)
+		}
+	}
+
+	for path, f := range t.files {
+		if !found[path] {
+			// The file was removed, read whatever is left.
+			t.readLines(f)
+			t.close(f)
+		}
+	}
+	t.positions = make(map[string]position)
+	t.scanned = true
+}
+
+// startOffset decides where to start reading a file that isn't open yet.
+func (t *Tailer) startOffset(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	if pos, ok := t.positions[path]; ok {
+		if pos.Inode == inode(info) && pos.Offset <= info.Size() {
+			return pos.Offset
+		}
+		// The file was rotated since the cursor was taken.
+		return 0
+	}
+	if !t.scanned && !t.readFromHead {
+		return info.Size()
+	}
+	return 0
+}
+
+// rotated checks whether the file at the path was replaced or truncated.
+func (t *Tailer) rotated(f *file) bool {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false
+	}
+	return inode(info) != f.inode || info.Size() < f.offset
+}
+
+func (t *Tailer) open(path string, offset int64) {
+	handler, err := t.handler.Open(path)
+	if err != nil {
+		logging.Error(err)
+		return
+	}
+
+	osFile, err := os.Open(path)
+	if err != nil {
+		logging.Error(errors.Wrapf(err, "Error opening %s", path))
+		return
+	}
+	info, err := osFile.Stat()
+	if err != nil {
+		osFile.Close()
+		logging.Error(errors.Wrapf(err, "Error getting info of %s", path))
+		return
+	}
+	if offset > info.Size() {
+		offset = 0
+	}
+	if _, err := osFile.Seek(offset, io.SeekStart); err != nil {
+		osFile.Close()
+		logging.Error(errors.Wrapf(err, "Error seeking in %s", path))
+		return
+	}
+
+	logging.Logger.Info("Tailing file", zap.String("path", path), zap.Int64("offset", offset))
+	t.files[path] = &file{
+		path:      path,
+		file:      osFile,
+		reader:    bufio.NewReader(osFile),
+		handler:   handler,
+		inode:     inode(info),
+		offset:    offset,
+		committed: offset,
+	}
+}
+
+func (t *Tailer) close(f *file) {
+	// The last line will never be terminated.
+	if len(f.pending) != 0 {
+		t.handleLine(f)
+	}
+	f.handler.Close(t.cursor)
+	f.file.Close()
+	delete(t.files, f.path)
+}
+
+func (t *Tailer) closeAll() {
+	for _, f := range t.files {
+		f.file.Close()
+	}
+}
+
+// readLines reads the complete lines that were appended to a file, and returns whether there were any.
+func (t *Tailer) readLines(f *file) bool {
+	read := false
+	for {
+		chunk, err := f.reader.ReadSlice('\n')
+		t.buffer(f, chunk)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				logging.Error(errors.Wrapf(err, "Error reading %s", f.path))
+			}
+			// Wait for the rest of the line to be written.
+			return read
+		}
+		read = true
+		t.handleLine(f)
+	}
+}
+
+// buffer adds part of a line to the pending line, up to the max line size.
+func (t *Tailer) buffer(f *file, chunk []byte) {
+	f.pendingSize += int64(len(chunk))
+	if room := t.maxLineSize - len(f.pending); len(chunk) > room {
+		if room > 0 {
+			logging.Logger.Warn("Truncating line", zap.String("path", f.path), zap.Int("size", t.maxLineSize))
+			chunk = chunk[:room]
+		} else {
+			chunk = nil
+		}
+	}
+	f.pending = append(f.pending, chunk...)
+}
+
+// handleLine hands the pending line to the handler.
+func (t *Tailer) handleLine(f *file) {
+	line := f.pending
+	f.offset += f.pendingSize
+	f.pending = nil
+	f.pendingSize = 0
+	if f.handler.Line(line, t.cursor) {
+		f.committed = f.offset
+	}
+}
+
+// snapshot updates the cursor with the positions up to which every line has been handled.
+func (t *Tailer) snapshot() {
+	positions := make(map[string]position, len(t.files))
+	for path, f := range t.files {
+		positions[path] = position{Inode: f.inode, Offset: f.committed}
+	}
+	serialized, err := json.Marshal(positions)
+	if err != nil {
+		logging.Error(errors.Wrap(err, "Error serializing cursor"))
+		return
+	}
+	t.cursor = types.Cursor(serialized)
+}
+
+func inode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
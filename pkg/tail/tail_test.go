@@ -0,0 +1,129 @@
+package tail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+type mockHandler struct {
+	lines   []string
+	cursors []types.Cursor
+}
+
+func (h *mockHandler) Open(path string) (LineHandler, error) {
+	return h, nil
+}
+
+// Lines ending with a backslash are continued by the next line.
+func (h *mockHandler) Line(line []byte, cursor types.Cursor) bool {
+	trimmed := strings.TrimSuffix(string(line), "\n")
+	h.lines = append(h.lines, trimmed)
+	h.cursors = append(h.cursors, cursor)
+	return !strings.HasSuffix(trimmed, `\`)
+}
+
+func (h *mockHandler) Close(cursor types.Cursor) {}
+
+func (h *mockHandler) reset() []string {
+	lines := h.lines
+	h.lines = nil
+	return lines
+}
+
+// expectLines checks the lines that were read, ignoring the order of lines from different files.
+func expectLines(t *testing.T, handler *mockHandler, expected ...string) {
+	t.Helper()
+	lines := handler.reset()
+	sort.Strings(lines)
+	sort.Strings(expected)
+	if (len(lines) != 0 || len(expected) != 0) && !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected lines %v, but got %v", expected, lines)
+	}
+}
+
+func TestTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "a.log")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("existing\n")
+
+	handler := &mockHandler{}
+	tailer := New(Config{Pattern: filepath.Join(dir, "*.log")}, handler)
+	now := time.Now()
+
+	// Existing lines are skipped on the first start, but new files are read from the beginning.
+	tailer.Poll(now)
+	expectLines(t, handler)
+	file.WriteString("1\n2")
+	ioutil.WriteFile(filepath.Join(dir, "b.log"), []byte("b1\n"), 0644)
+	tailer.Poll(now.Add(DefaultRescanInterval))
+	expectLines(t, handler, "1", "b1")
+
+	// Rotated files are read to the end before the new file is opened.
+	file.WriteString("\n3\n")
+	file.Close()
+	os.Rename(path, path+".1")
+	ioutil.WriteFile(path, []byte("4\n"), 0644)
+	tailer.Poll(now.Add(DefaultRescanInterval * 2))
+	expectLines(t, handler, "2", "3", "4")
+
+	// Take a snapshot while a partial message is pending.
+	file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.WriteString(`5\` + "\n")
+	tailer.Poll(now.Add(DefaultRescanInterval * 2))
+	file.WriteString("6\n")
+	tailer.Poll(now.Add(DefaultRescanInterval * 3))
+	expectLines(t, handler, `5\`, "6")
+	cursor := handler.cursors[len(handler.cursors)-1]
+
+	// Resuming repeats the partial message, and reads the files that were created in the meantime.
+	ioutil.WriteFile(filepath.Join(dir, "c.log"), []byte("c1\n"), 0644)
+	resumedHandler := &mockHandler{}
+	resumed := New(Config{Pattern: filepath.Join(dir, "*.log"), Cursor: cursor}, resumedHandler)
+	resumed.Poll(now)
+	expectLines(t, resumedHandler, `5\`, "6", "c1")
+}
+
+func TestLongAndUnterminatedLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	handler := &mockHandler{}
+	tailer := New(Config{Pattern: filepath.Join(dir, "*.log"), MaxLineSize: 5000}, handler)
+	now := time.Now()
+	tailer.Poll(now)
+
+	// Long lines are truncated, and the rest of them is skipped.
+	path := filepath.Join(dir, "a.log")
+	ioutil.WriteFile(path, []byte(strings.Repeat("a", 10000)+"\n1\n2"), 0644)
+	tailer.Poll(now.Add(DefaultRescanInterval))
+	expectLines(t, handler, strings.Repeat("a", 5000), "1")
+
+	// The unterminated last line of a removed file is handled.
+	os.Remove(path)
+	tailer.Poll(now.Add(DefaultRescanInterval * 2))
+	expectLines(t, handler, "2")
+}
@@ -0,0 +1,99 @@
+// Package template renders text/template strings against log records.
+//
+// It is used by destinations that derive names (object keys, topics, tags, etc) from the records
+// they deliver. Templates are executed with a value that exposes the record:
+//
+//	{{.Time.Format "2006/01/02"}}           record time (UTC)
+//	{{.Field "kubernetes.namespace_name"}}  value of a (nested) record field, or an empty string
+//	{{hostname}}                            hostname of the machine
+//	{{.Field "app" | default "unknown"}}    fallback for empty values
+package template
+
+import (
+	"bytes"
+	"os"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+// Template is a compiled record template
+type Template struct {
+	text     string
+	template *texttemplate.Template
+}
+
+var hostname, _ = os.Hostname()
+
+var funcs = texttemplate.FuncMap{
+	"hostname": func() string {
+		return hostname
+	},
+	"default": func(fallback, value string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	},
+}
+
+// New compiles a record template
+func New(text string) (*Template, error) {
+	compiled, err := texttemplate.New("record").Funcs(funcs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing template %s", text)
+	}
+	return &Template{
+		text:     text,
+		template: compiled,
+	}, nil
+}
+
+// Must is like New, but panics if the template can't be compiled.
+func Must(text string) *Template {
+	compiled, err := New(text)
+	if err != nil {
+		panic(err)
+	}
+	return compiled
+}
+
+// Execute renders the template for a record
+func (t *Template) Execute(rec *types.Record) (string, error) {
+	var buf bytes.Buffer
+	err := t.template.Execute(&buf, newData(rec))
+	if err != nil {
+		return "", errors.Wrapf(err, "Error executing template %s", t.text)
+	}
+	return buf.String(), nil
+}
+
+// String returns the source of the template
+func (t *Template) String() string {
+	return t.text
+}
+
+type data struct {
+	// Time is the record time in UTC, or the current time if the record has none.
+	Time   time.Time
+	record *types.Record
+}
+
+func newData(rec *types.Record) data {
+	recordTime := rec.Time
+	if recordTime.IsZero() {
+		recordTime = time.Now()
+	}
+	return data{
+		Time:   recordTime.UTC(),
+		record: rec,
+	}
+}
+
+// Field returns the string value of a (nested) record field, or an empty string if it isn't present.
+func (d data) Field(path string) string {
+	val, _ := d.record.LookupString(path)
+	return val
+}
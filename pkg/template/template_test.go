@@ -0,0 +1,59 @@
+package template
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+func TestExecute(t *testing.T) {
+	record := &types.Record{
+		Time: time.Date(2017, 4, 3, 15, 32, 45, 0, time.FixedZone("PDT", -7*60*60)),
+		Fields: map[string]interface{}{
+			"kubernetes": map[string]interface{}{
+				"namespace_name": "default",
+			},
+		},
+	}
+
+	testCases := []struct {
+		template string
+		expected string
+	}{
+		{
+			template: `{{.Time.Format "2006/01/02/15"}}/{{.Field "kubernetes.namespace_name"}}`,
+			expected: "2017/04/03/22/default",
+		},
+		{
+			template: `{{.Field "kubernetes.pod_name" | default "none"}}`,
+			expected: "none",
+		},
+		{
+			template: `logs.{{.Field "kubernetes.namespace_name" | default "none"}}`,
+			expected: "logs.default",
+		},
+		{
+			template: `{{hostname}}`,
+			expected: hostname,
+		},
+	}
+
+	for _, testCase := range testCases {
+		tmpl, err := New(testCase.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		val, err := tmpl.Execute(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val != testCase.expected {
+			t.Errorf("Expected template '%s' to render '%s', but got '%s'", testCase.template, testCase.expected, val)
+		}
+	}
+
+	if _, err := New("{{.Field"); err == nil {
+		t.Errorf("Expected an error parsing an invalid template")
+	}
+}
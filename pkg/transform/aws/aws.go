@@ -1,10 +1,20 @@
-// Package aws reads ec2 metadata instance environment variables and sets them on the logs.
+// Package aws reads the instance metadata from the EC2 metadata service (IMDSv2) and sets it on the
+// logs. The instance environment variables override it, or are used instead when the metadata
+// service can't be reached.
 package aws
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/wearefair/log-aggregator/pkg/transform"
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/logging"
 	"github.com/wearefair/log-aggregator/pkg/types"
 )
 
@@ -17,24 +27,265 @@ const (
 	EnvLocalHostname = "EC2_METADATA_LOCAL_HOSTNAME"
 )
 
-func New() transform.Transformer {
-	meta := metadata{
-		InstanceId:    os.Getenv(EnvInstanceId),
-		LocalIpv4:     os.Getenv(EnvLocalIpv4),
-		LocalHostname: os.Getenv(EnvLocalHostname),
+const (
+	DefaultEndpoint        = "http://169.254.169.254"
+	DefaultRefreshInterval = time.Minute * 5
+
+	tokenTTL       = time.Hour * 6
+	imdsTimeout    = time.Second * 2
+	tokenHeader    = "X-aws-ec2-metadata-token"
+	tokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+)
+
+type Config struct {
+	// Endpoint of the metadata service, as a URL or host:port. Defaults to DefaultEndpoint.
+	Endpoint string
+	// Disabled only uses the instance environment variables.
+	Disabled bool
+	// Tags are the instance tags to add to records. Tags have to be allowed in the instance metadata
+	// options of the instance.
+	Tags []string
+	// RefreshInterval is how often the metadata is fetched again, e.g. for changed tags.
+	RefreshInterval time.Duration
+}
+
+type Client struct {
+	sync.RWMutex
+	endpoint string
+	tags     []string
+	client   *http.Client
+	meta     metadata
+
+	// The session token, and when it has to be renewed.
+	token        string
+	tokenExpires time.Time
+
+	// Closed to stop refreshing.
+	stop chan struct{}
+}
+
+// New fetches the instance metadata, and keeps refreshing it in the background until Stop is called.
+// The first fetch blocks, so that the first records have the metadata too. When the metadata
+// service can't be reached this takes up to the 2 second request timeout, and a few times that if
+// it's slow to respond.
+func New(conf Config) *Client {
+	endpoint := DefaultEndpoint
+	if conf.Endpoint != "" {
+		endpoint = conf.Endpoint
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+	}
+	refreshInterval := DefaultRefreshInterval
+	if conf.RefreshInterval != 0 {
+		refreshInterval = conf.RefreshInterval
+	}
+
+	c := &Client{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		tags:     conf.Tags,
+		client:   &http.Client{Timeout: imdsTimeout},
+		meta:     withEnv(metadata{}),
+		stop:     make(chan struct{}),
+	}
+	if !conf.Disabled {
+		c.refresh()
+		go c.refreshEvery(refreshInterval)
+	}
+	return c
+}
+
+// Stop stops refreshing the metadata.
+func (c *Client) Stop() {
+	close(c.stop)
+}
+
+func (c *Client) refreshEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.refresh()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *Client) Transform(rec *types.Record) (*types.Record, error) {
+	c.RLock()
+	rec.Fields["aws"] = c.meta
+	c.RUnlock()
+	return rec, nil
+}
+
+// refresh fetches the metadata, and keeps the previous metadata if it can't be fetched.
+func (c *Client) refresh() {
+	meta, err := c.fetch()
+	if err != nil {
+		logging.Error(errors.Wrap(err, "Error fetching the instance metadata"))
+		return
+	}
+	c.Lock()
+	c.meta = withEnv(meta)
+	c.Unlock()
+}
+
+func (c *Client) fetch() (metadata, error) {
+	var meta metadata
+	document, err := c.get("/latest/dynamic/instance-identity/document")
+	if err != nil {
+		return meta, err
+	}
+	var identity instanceIdentity
+	if err := json.Unmarshal([]byte(document), &identity); err != nil {
+		return meta, errors.Wrap(err, "Error decoding the instance identity document")
+	}
+	meta.InstanceId = identity.InstanceId
+	meta.InstanceType = identity.InstanceType
+	meta.AvailabilityZone = identity.AvailabilityZone
+	meta.Region = identity.Region
+	meta.AmiId = identity.ImageId
+	meta.AccountId = identity.AccountId
+	meta.LocalIpv4 = identity.PrivateIp
+
+	// Instances without a public address don't have these. They are best-effort, so that an error
+	// doesn't discard the rest of the metadata.
+	for path, field := range map[string]*string{
+		"local-hostname":  &meta.LocalHostname,
+		"public-hostname": &meta.PublicHostname,
+		"public-ipv4":     &meta.PublicIpv4,
+	} {
+		if *field, err = c.getOptional("/latest/meta-data/" + path); err != nil {
+			logging.Error(err)
+		}
+	}
+	for _, tag := range c.tags {
+		value, err := c.getOptional("/latest/meta-data/tags/instance/" + tag)
+		if err != nil {
+			logging.Error(err)
+			continue
+		}
+		if value != "" {
+			if meta.Tags == nil {
+				meta.Tags = make(map[string]string)
+			}
+			meta.Tags[tag] = value
+		}
+	}
+	return meta, nil
+}
+
+// getOptional returns an empty value for metadata that doesn't exist.
+func (c *Client) getOptional(path string) (string, error) {
+	value, err := c.get(path)
+	if err == errNotFound {
+		return "", nil
+	}
+	return value, err
+}
+
+var errNotFound = errors.New("Instance metadata not found")
+
+func (c *Client) get(path string) (string, error) {
+	token, err := c.sessionToken()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, c.endpoint+path, nil)
+	if err != nil {
+		return "", err
 	}
+	req.Header.Set(tokenHeader, token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error getting %s", path)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", errNotFound
+	case http.StatusUnauthorized:
+		// The token expired early, e.g. because the metadata service was restarted.
+		c.token = ""
+		return "", errors.Errorf("Error getting %s: %s", path, resp.Status)
+	default:
+		return "", errors.Errorf("Error getting %s: %s", path, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "Error reading %s", path)
+	}
+	return string(body), nil
+}
 
-	return func(rec *types.Record) (*types.Record, error) {
-		rec.Fields["aws"] = meta
-		return rec, nil
+// sessionToken returns the IMDSv2 session token, requesting a new one when it's about to expire.
+// Only refresh uses the token, so it doesn't need a lock.
+func (c *Client) sessionToken() (string, error) {
+	now := time.Now()
+	if c.token != "" && now.Before(c.tokenExpires) {
+		return c.token, nil
+	}
+	req, err := http.NewRequest(http.MethodPut, c.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(tokenTTLHeader, strconv.Itoa(int(tokenTTL.Seconds())))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "Error getting an instance metadata token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("Error getting an instance metadata token: %s", resp.Status)
 	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "Error reading the instance metadata token")
+	}
+	c.token = string(body)
+	// Renew early, so the token doesn't expire between requests.
+	c.tokenExpires = now.Add(tokenTTL - time.Minute)
+	return c.token, nil
+}
+
+// withEnv overrides the metadata with the instance environment variables that are set.
+func withEnv(meta metadata) metadata {
+	for env, field := range map[string]*string{
+		EnvInstanceId:    &meta.InstanceId,
+		EnvLocalIpv4:     &meta.LocalIpv4,
+		EnvLocalHostname: &meta.LocalHostname,
+	} {
+		if value := os.Getenv(env); value != "" {
+			*field = value
+		}
+	}
+	return meta
+}
+
+// instanceIdentity is the instance identity document.
+type instanceIdentity struct {
+	InstanceId       string `json:"instanceId"`
+	InstanceType     string `json:"instanceType"`
+	AvailabilityZone string `json:"availabilityZone"`
+	Region           string `json:"region"`
+	ImageId          string `json:"imageId"`
+	AccountId        string `json:"accountId"`
+	PrivateIp        string `json:"privateIp"`
 }
 
 type metadata struct {
-	InstanceId     string `json:"instance_id,omitempty"`
-	InstanceType   string `json:"instance_type,omitempty"`
-	LocalHostname  string `json:"local_hostname,omitempty"`
-	LocalIpv4      string `json:"local_ipv4,omitempty"`
-	PublicHostname string `json:"public_hostname,omitempty"`
-	PublicIpv4     string `json:"public_ipv4,omitempty"`
+	InstanceId       string            `json:"instance_id,omitempty"`
+	InstanceType     string            `json:"instance_type,omitempty"`
+	AvailabilityZone string            `json:"availability_zone,omitempty"`
+	Region           string            `json:"region,omitempty"`
+	AmiId            string            `json:"ami_id,omitempty"`
+	AccountId        string            `json:"account_id,omitempty"`
+	LocalHostname    string            `json:"local_hostname,omitempty"`
+	LocalIpv4        string            `json:"local_ipv4,omitempty"`
+	PublicHostname   string            `json:"public_hostname,omitempty"`
+	PublicIpv4       string            `json:"public_ipv4,omitempty"`
+	Tags             map[string]string `json:"tags,omitempty"`
 }
@@ -0,0 +1,116 @@
+package aws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+const testToken = "token"
+
+// newIMDS stands in for the metadata service, requiring a session token like IMDSv2.
+func newIMDS(values map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if r.Method != http.MethodPut || r.Header.Get(tokenTTLHeader) == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(testToken))
+			return
+		}
+		if r.Header.Get(tokenHeader) != testToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		value, ok := values[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if value == "error" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(value))
+	}))
+}
+
+func transform(t *testing.T, c *Client) metadata {
+	rec, err := c.Transform(&types.Record{Fields: map[string]interface{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.Fields["aws"].(metadata)
+}
+
+func TestIMDS(t *testing.T) {
+	values := map[string]string{
+		"/latest/dynamic/instance-identity/document": `{"instanceId":"i-123","instanceType":"m5.large",` +
+			`"availabilityZone":"us-east-1a","region":"us-east-1","imageId":"ami-456","accountId":"789",` +
+			`"privateIp":"10.0.0.1"}`,
+		"/latest/meta-data/local-hostname":     "ip-10-0-0-1.ec2.internal",
+		"/latest/meta-data/tags/instance/team": "logs",
+	}
+	imds := newIMDS(values)
+	defer imds.Close()
+
+	c := New(Config{Endpoint: imds.URL, Tags: []string{"team", "missing"}, RefreshInterval: time.Hour})
+	defer c.Stop()
+	expected := metadata{
+		InstanceId:       "i-123",
+		InstanceType:     "m5.large",
+		AvailabilityZone: "us-east-1a",
+		Region:           "us-east-1",
+		AmiId:            "ami-456",
+		AccountId:        "789",
+		LocalHostname:    "ip-10-0-0-1.ec2.internal",
+		LocalIpv4:        "10.0.0.1",
+		Tags:             map[string]string{"team": "logs"},
+	}
+	if meta := transform(t, c); !reflect.DeepEqual(meta, expected) {
+		t.Errorf("Expected %+v, but got %+v", expected, meta)
+	}
+
+	// The environment overrides the metadata service.
+	os.Setenv(EnvLocalHostname, "node-1")
+	defer os.Unsetenv(EnvLocalHostname)
+	values["/latest/meta-data/public-ipv4"] = "1.2.3.4"
+	c.refresh()
+	meta := transform(t, c)
+	if meta.LocalHostname != "node-1" || meta.PublicIpv4 != "1.2.3.4" {
+		t.Errorf("Expected refreshed metadata with the environment override, but got %+v", meta)
+	}
+
+	// Optional metadata is best-effort.
+	values["/latest/meta-data/public-ipv4"] = "error"
+	c.refresh()
+	if meta := transform(t, c); meta.PublicIpv4 != "" || meta.Tags["team"] != "logs" {
+		t.Errorf("Expected the metadata without the public IP, but got %+v", meta)
+	}
+
+	// The last metadata is kept when the metadata service goes away.
+	imds.Close()
+	c.refresh()
+	if meta := transform(t, c); meta.InstanceType != "m5.large" {
+		t.Errorf("Expected the previous metadata, but got %+v", meta)
+	}
+}
+
+func TestEnvFallback(t *testing.T) {
+	os.Setenv(EnvInstanceId, "i-env")
+	defer os.Unsetenv(EnvInstanceId)
+	imds := newIMDS(nil)
+	imds.Close()
+
+	c := New(Config{Endpoint: imds.URL, RefreshInterval: time.Hour})
+	defer c.Stop()
+	if meta := transform(t, c); !reflect.DeepEqual(meta, metadata{InstanceId: "i-env"}) {
+		t.Errorf("Expected the environment metadata, but got %+v", meta)
+	}
+}
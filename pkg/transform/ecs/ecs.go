@@ -0,0 +1,138 @@
+// Package ecs adds the ECS task of a container to its logs, from the task metadata endpoint (v4).
+package ecs
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/logging"
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+const (
+	CONTAINER_ID_FULL = "CONTAINER_ID_FULL"
+	// Set by the ECS agent in the containers of a task.
+	EnvMetadataURI = "ECS_CONTAINER_METADATA_URI_V4"
+
+	metadataTimeout = time.Second * 2
+	// The task is fetched at most this often, so that records of unknown containers don't flood the
+	// endpoint.
+	minFetchInterval = time.Second * 10
+)
+
+type Config struct {
+	// Endpoint is the task metadata endpoint, the value of ECS_CONTAINER_METADATA_URI_V4.
+	Endpoint string
+}
+
+// Client maps the containers of the task that the log-aggregator runs in (e.g. as a sidecar) to the
+// task metadata. The task is fetched again when a container that isn't known yet logs.
+type Client struct {
+	sync.Mutex
+	url        string
+	client     *http.Client
+	containers map[string]metadataECS
+	lastFetch  time.Time
+}
+
+func New(conf Config) *Client {
+	return &Client{
+		url:        strings.TrimSuffix(conf.Endpoint, "/") + "/task",
+		client:     &http.Client{Timeout: metadataTimeout},
+		containers: make(map[string]metadataECS),
+	}
+}
+
+func (c *Client) Transform(rec *types.Record) (*types.Record, error) {
+	containerId, ok := rec.Fields[CONTAINER_ID_FULL].(string)
+	if !ok || containerId == "" {
+		return rec, nil
+	}
+	if metadata, ok := c.container(containerId, time.Now()); ok {
+		rec.Fields["ecs"] = metadata
+	}
+	return rec, nil
+}
+
+// container returns the metadata of a container, fetching the task if the container isn't known.
+// Records aren't held up while the task is fetched, records of unknown containers that are
+// transformed in the meantime don't get metadata.
+func (c *Client) container(containerId string, now time.Time) (metadataECS, bool) {
+	c.Lock()
+	if metadata, ok := c.containers[containerId]; ok {
+		c.Unlock()
+		return metadata, true
+	}
+	if now.Sub(c.lastFetch) < minFetchInterval {
+		c.Unlock()
+		return metadataECS{}, false
+	}
+	c.lastFetch = now
+	c.Unlock()
+
+	containers, err := c.fetch()
+	if err != nil {
+		logging.Error(err)
+		return metadataECS{}, false
+	}
+	c.Lock()
+	c.containers = containers
+	c.Unlock()
+	metadata, ok := containers[containerId]
+	return metadata, ok
+}
+
+// fetch returns the metadata of the containers of the task, by Docker container ID.
+func (c *Client) fetch() (map[string]metadataECS, error) {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting the ECS task metadata")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Error getting the ECS task metadata: %s", resp.Status)
+	}
+	var task taskMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&task); err != nil {
+		return nil, errors.Wrap(err, "Error decoding the ECS task metadata")
+	}
+
+	containers := make(map[string]metadataECS)
+	for _, container := range task.Containers {
+		containers[container.DockerId] = metadataECS{
+			Cluster:       task.Cluster,
+			TaskArn:       task.TaskARN,
+			TaskFamily:    task.Family,
+			TaskRevision:  task.Revision,
+			ServiceName:   task.ServiceName,
+			ContainerName: container.Name,
+		}
+	}
+	return containers, nil
+}
+
+// taskMetadata is the response of the task metadata endpoint.
+type taskMetadata struct {
+	Cluster     string
+	TaskARN     string
+	Family      string
+	Revision    string
+	ServiceName string
+	Containers  []struct {
+		DockerId string
+		Name     string
+	}
+}
+
+type metadataECS struct {
+	Cluster       string `json:"cluster,omitempty"`
+	TaskArn       string `json:"task_arn,omitempty"`
+	TaskFamily    string `json:"task_family,omitempty"`
+	TaskRevision  string `json:"task_revision,omitempty"`
+	ServiceName   string `json:"service_name,omitempty"`
+	ContainerName string `json:"container_name,omitempty"`
+}
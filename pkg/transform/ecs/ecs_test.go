@@ -0,0 +1,107 @@
+package ecs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+const task = `{
+  "Cluster": "arn:aws:ecs:us-east-1:123456789012:cluster/default",
+  "TaskARN": "arn:aws:ecs:us-east-1:123456789012:task/default/158d1c8083dd49d6b527399fd6414f5c",
+  "Family": "web",
+  "Revision": "7",
+  "ServiceName": "web-service",
+  "Containers": [
+    {"DockerId": "731a0d6a3b4210e2448339bc7015aaa79bfe4fa256384f4102db86ef94cbbc4c", "Name": "nginx"},
+    {"DockerId": "ee08638adaaf009d78c248913f629e38299471d45fe7dc944d1039077e3424ca", "Name": "log-aggregator"}
+  ]
+}`
+
+func TestTransform(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/v4/abc/task" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(task))
+	}))
+	defer server.Close()
+
+	ecs := New(Config{Endpoint: server.URL + "/v4/abc"})
+	rec, err := ecs.Transform(&types.Record{Fields: map[string]interface{}{
+		CONTAINER_ID_FULL: "731a0d6a3b4210e2448339bc7015aaa79bfe4fa256384f4102db86ef94cbbc4c",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := metadataECS{
+		Cluster:       "arn:aws:ecs:us-east-1:123456789012:cluster/default",
+		TaskArn:       "arn:aws:ecs:us-east-1:123456789012:task/default/158d1c8083dd49d6b527399fd6414f5c",
+		TaskFamily:    "web",
+		TaskRevision:  "7",
+		ServiceName:   "web-service",
+		ContainerName: "nginx",
+	}
+	if rec.Fields["ecs"] != expected {
+		t.Errorf("Expected %+v, but got %+v", expected, rec.Fields["ecs"])
+	}
+
+	// Unknown containers don't fetch the task again right away.
+	for i := 0; i < 3; i++ {
+		rec, _ = ecs.Transform(&types.Record{Fields: map[string]interface{}{CONTAINER_ID_FULL: "unknown"}})
+		if _, ok := rec.Fields["ecs"]; ok {
+			t.Errorf("Did not expect metadata for an unknown container")
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected the task to be fetched once, but got %d requests", requests)
+	}
+	if _, ok := ecs.container("unknown", time.Now().Add(minFetchInterval)); ok || requests != 2 {
+		t.Errorf("Expected the task to be fetched again after the interval, but got %d requests", requests)
+	}
+}
+
+func TestFetchDoesNotBlock(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	fetched := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only the first fetch answers right away.
+		if fetched++; fetched > 1 {
+			started <- struct{}{}
+			<-release
+		}
+		w.Write([]byte(task))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ecs := New(Config{Endpoint: server.URL + "/v4/abc"})
+	now := time.Now()
+	if _, ok := ecs.container("731a0d6a3b4210e2448339bc7015aaa79bfe4fa256384f4102db86ef94cbbc4c", now); !ok {
+		t.Fatal("Expected metadata for a container of the task")
+	}
+	go ecs.container("unknown", now.Add(minFetchInterval))
+	<-started
+
+	// Known containers are looked up while the task is fetched again.
+	done := make(chan bool)
+	go func() {
+		_, ok := ecs.container("731a0d6a3b4210e2448339bc7015aaa79bfe4fa256384f4102db86ef94cbbc4c", now.Add(minFetchInterval))
+		done <- ok
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Errorf("Expected metadata for a container of the task")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected known containers not to wait for the task to be fetched")
+	}
+}
@@ -0,0 +1,186 @@
+package k8
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/logging"
+	jsontransform "github.com/wearefair/log-aggregator/pkg/transform/json"
+	"github.com/wearefair/log-aggregator/pkg/types"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// Pod annotations that control how the logs of a pod are processed. They apply to every container
+	// of the pod, unless overridden for a container with the container name as suffix, e.g.
+	// log-aggregator/parser.nginx
+	AnnotationExclude          = "log-aggregator/exclude"
+	AnnotationParser           = "log-aggregator/parser"
+	AnnotationMultilinePattern = "log-aggregator/multiline-pattern"
+	AnnotationDestination      = "log-aggregator/destination"
+
+	ParserJSON   = "json"
+	ParserLogfmt = "logfmt"
+	ParserNginx  = "nginx"
+
+	nginxTimeLayout = "02/Jan/2006:15:04:05 -0700"
+)
+
+// The nginx combined log format
+var nginxRegexp = regexp.MustCompile(`^(?P<remote_addr>\S+) \S+ (?P<remote_user>\S+) \[(?P<time_local>[^\]]+)\] ` +
+	`"(?P<method>\S+) (?P<path>\S+) (?P<protocol>[^"]+)" (?P<status>\d{3}) (?P<body_bytes_sent>\d+|-)` +
+	`(?: "(?P<http_referer>[^"]*)" "(?P<http_user_agent>[^"]*)")?`)
+
+// logControls are the processing options of a container's logs.
+type logControls struct {
+	Exclude     bool
+	Parser      string
+	Multiline   *regexp.Regexp
+	Destination string
+}
+
+// podControls are the processing options of a pod's containers.
+type podControls struct {
+	// For containers that aren't in the pod spec
+	pod        logControls
+	containers map[string]logControls
+}
+
+// parseControls reads the processing options of every container from the pod annotations.
+func parseControls(pod *v1.Pod) podControls {
+	controls := podControls{
+		pod:        containerControls(pod, ""),
+		containers: make(map[string]logControls),
+	}
+	for _, container := range pod.Spec.InitContainers {
+		controls.containers[container.Name] = containerControls(pod, container.Name)
+	}
+	for _, container := range pod.Spec.Containers {
+		controls.containers[container.Name] = containerControls(pod, container.Name)
+	}
+	return controls
+}
+
+func (c podControls) forContainer(containerName string) logControls {
+	if controls, ok := c.containers[containerName]; ok {
+		return controls
+	}
+	return c.pod
+}
+
+func containerControls(pod *v1.Pod, containerName string) logControls {
+	annotation := func(name string) string {
+		if value, ok := pod.Annotations[name+"."+containerName]; ok && containerName != "" {
+			return value
+		}
+		return pod.Annotations[name]
+	}
+
+	controls := logControls{
+		Exclude:     annotation(AnnotationExclude) == "true",
+		Destination: annotation(AnnotationDestination),
+	}
+	switch parser := annotation(AnnotationParser); parser {
+	case "", ParserJSON, ParserLogfmt, ParserNginx:
+		controls.Parser = parser
+	default:
+		logging.Error(errors.Errorf("Unknown parser %s for pod %s/%s", parser, pod.Namespace, pod.Name))
+	}
+	if pattern := annotation(AnnotationMultilinePattern); pattern != "" {
+		multiline, err := regexp.Compile(pattern)
+		if err != nil {
+			logging.Error(errors.Wrapf(err, "Invalid multiline pattern for pod %s/%s", pod.Namespace, pod.Name))
+		}
+		controls.Multiline = multiline
+	}
+	return controls
+}
+
+// parse parses the log field of a record, and copies the parsed fields onto the root of the record.
+// Lines that can't be parsed are left as they are.
+func parse(rec *types.Record, parser string) {
+	log, ok := rec.Fields["log"].(string)
+	if !ok {
+		return
+	}
+	switch parser {
+	case ParserJSON:
+		jsontransform.Transform(rec)
+	case ParserLogfmt:
+		for k, v := range parseLogfmt(log) {
+			rec.Fields[k] = v
+		}
+	case ParserNginx:
+		fields := matchRegex(log, nginxRegexp)
+		if fields == nil {
+			return
+		}
+		for k, v := range fields {
+			if v != "" {
+				rec.Fields[k] = v
+			}
+		}
+		if parsed, err := time.Parse(nginxTimeLayout, fields["time_local"]); err == nil {
+			rec.Time = parsed
+		}
+	}
+}
+
+// parseLogfmt parses a line of key=value pairs, where values can be double quoted. Keys without an
+// equals sign are set to "true".
+func parseLogfmt(line string) map[string]string {
+	fields := make(map[string]string)
+	for line = strings.TrimLeft(line, " "); line != ""; line = strings.TrimLeft(line, " ") {
+		end := strings.IndexAny(line, "= ")
+		if end < 0 {
+			fields[line] = "true"
+			break
+		}
+		key := line[:end]
+		if line[end] == ' ' {
+			if key != "" {
+				fields[key] = "true"
+			}
+			line = line[end+1:]
+			continue
+		}
+
+		line = line[end+1:]
+		var value string
+		if line != "" && line[0] == '"' {
+			value, line = parseQuoted(line)
+		} else {
+			end = strings.IndexByte(line, ' ')
+			if end < 0 {
+				end = len(line)
+			}
+			value, line = line[:end], line[end:]
+		}
+		if key != "" {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// parseQuoted parses a double quoted value with backslash escapes, and returns the rest of the line.
+func parseQuoted(line string) (string, string) {
+	var value strings.Builder
+	for i := 1; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if i+1 < len(line) {
+				i++
+				value.WriteByte(line[i])
+			}
+		case '"':
+			return value.String(), line[i+1:]
+		default:
+			value.WriteByte(line[i])
+		}
+	}
+	// Unterminated quote
+	return value.String(), ""
+}
@@ -0,0 +1,112 @@
+package k8
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/logging"
+	"go.uber.org/zap"
+	fsnotify "gopkg.in/fsnotify/fsnotify.v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// The service account credentials that are mounted into pods, used with InCluster.
+	serviceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCAPath    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+func newK8(conf Config) (*kubernetes.Clientset, error) {
+	var config *rest.Config
+	var err error
+	if conf.InCluster {
+		config, err = rest.InClusterConfig()
+	} else {
+		config, err = clientcmd.BuildConfigFromFlags("", conf.K8ConfigPath)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting config from path")
+	}
+
+	// creates the clientset
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "error constructing k8 client from config")
+	}
+	return clientset, nil
+}
+
+// credentialFile is a file that the client is built from.
+type credentialFile struct {
+	path string
+	// Whether the client has to be rebuilt when the contents change, rather than only when the file
+	// is created or removed.
+	contents bool
+}
+
+// credentialFiles returns the files that the client is built from. The first one has to exist for
+// the client to be built. client-go reads the service account token again when it's rotated, so only
+// changes of the CA require a new client.
+func credentialFiles(conf Config) []credentialFile {
+	if conf.InCluster {
+		return []credentialFile{{path: serviceAccountTokenPath}, {path: serviceAccountCAPath, contents: true}}
+	}
+	return []credentialFile{{path: conf.K8ConfigPath, contents: true}}
+}
+
+// readCredentials returns the state of the credential files, to tell when they changed. Missing
+// files are read as empty.
+func readCredentials(files []credentialFile) string {
+	var state string
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file.path)
+		if !file.contents {
+			data = []byte(strconv.FormatBool(err == nil))
+		}
+		state += string(data) + "\x00"
+	}
+	return state
+}
+
+// watchCredentials rebuilds the tracker whenever the credential files change, e.g. when the kubeconfig
+// is created after starting or when credentials are rotated. The directories are watched rather than
+// the files, as files are usually replaced instead of written to (kubernetes swaps a symlink to
+// update mounted secrets). loaded are the credentials the current tracker was built from.
+func watchCredentials(client *Client, files []credentialFile, loaded string, build func() (tracker, error)) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		panic(err)
+	}
+	defer watcher.Close()
+
+	for _, file := range files {
+		if err := watcher.Add(filepath.Dir(file.path)); err != nil {
+			panic(err)
+		}
+	}
+
+	for {
+		select {
+		case event := <-watcher.Events:
+			credentials := readCredentials(files)
+			if credentials == loaded {
+				continue
+			}
+			logging.Logger.Info("Creating new tracker for changed k8 credentials", zap.String("name", event.Name))
+			tracker, err := build()
+			if err != nil {
+				// The old tracker is kept, and the credentials are read again on the next change.
+				logging.Error(errors.Wrap(err, "Got error creating k8 tracker on fsnotify"))
+				continue
+			}
+			client.setTracker(tracker)
+			loaded = credentials
+		case err := <-watcher.Errors:
+			logging.Error(errors.Wrap(err, "Got error watching k8 credentials"))
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package k8
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/pkg/errors"
+	"github.com/wearefair/log-aggregator/pkg/logging"
+)
+
+const (
+	dockerTimeout = time.Second * 2
+	// Number of containers to cache the Docker metadata of.
+	maxDockerCache = 1000
+	// How long containers that couldn't be looked up (e.g. while docker restarts) aren't looked up again.
+	dockerErrorTTL = time.Second * 10
+)
+
+// dockerClient looks up containers with the Docker Engine API on the local socket. Containers don't
+// change after they are created, so containers that were found are only looked up once.
+type dockerClient struct {
+	client *http.Client
+	labels []string
+	cache  *lru.Cache
+	now    func() time.Time
+}
+
+// cachedContainer is the metadata of a container, which is valid until it expires if it's set.
+type cachedContainer struct {
+	metadata metadataDocker
+	expires  time.Time
+}
+
+func newDockerClient(socket string, labels []string) *dockerClient {
+	cache, err := lru.New(maxDockerCache)
+	if err != nil {
+		panic(err)
+	}
+	dialer := &net.Dialer{}
+	return &dockerClient{
+		client: &http.Client{
+			Timeout: dockerTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		labels: labels,
+		cache:  cache,
+		now:    time.Now,
+	}
+}
+
+// container returns the metadata of a container. Containers that aren't known to docker are cached
+// without metadata, so that the API isn't called for every record, and other errors are cached for
+// a short time.
+func (d *dockerClient) container(containerId string) metadataDocker {
+	now := d.now()
+	if val, ok := d.cache.Get(containerId); ok {
+		cached := val.(*cachedContainer)
+		if cached.expires.IsZero() || now.Before(cached.expires) {
+			return cached.metadata
+		}
+	}
+	metadata, err := d.inspect(containerId)
+	metadata.ContainerId = containerId
+	cached := &cachedContainer{metadata: metadata}
+	// Containers of other runtimes (e.g. containerd) aren't known to docker.
+	if err != nil && err != errDockerNotFound {
+		logging.Error(err)
+		cached.expires = now.Add(dockerErrorTTL)
+	}
+	d.cache.Add(containerId, cached)
+	return metadata
+}
+
+func (d *dockerClient) inspect(containerId string) (metadataDocker, error) {
+	var metadata metadataDocker
+	var container struct {
+		Name   string
+		Image  string
+		Config struct {
+			Image  string
+			Labels map[string]string
+		}
+	}
+	if err := d.get("/containers/"+url.PathEscape(containerId)+"/json", &container); err != nil {
+		return metadata, err
+	}
+	metadata.ContainerName = strings.TrimPrefix(container.Name, "/")
+	metadata.Image = container.Config.Image
+	// The image ID is the digest of the local image, the registry digest is preferred if it was pulled.
+	metadata.ImageDigest = container.Image
+	var image struct {
+		RepoDigests []string
+	}
+	if err := d.get("/images/"+url.PathEscape(container.Image)+"/json", &image); err == nil && len(image.RepoDigests) > 0 {
+		if i := strings.LastIndex(image.RepoDigests[0], "@"); i >= 0 {
+			metadata.ImageDigest = image.RepoDigests[0][i+1:]
+		}
+	}
+	for _, name := range d.labels {
+		if value, ok := container.Config.Labels[name]; ok {
+			if metadata.Labels == nil {
+				metadata.Labels = make(map[string]string)
+			}
+			metadata.Labels[name] = value
+		}
+	}
+	return metadata, nil
+}
+
+var errDockerNotFound = errors.New("Not found in docker")
+
+func (d *dockerClient) get(path string, v interface{}) error {
+	// The host is ignored, requests go to the socket.
+	resp, err := d.client.Get("http://docker" + path)
+	if err != nil {
+		return errors.Wrapf(err, "Error getting %s from docker", path)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errDockerNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("Error getting %s from docker: %s", path, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.Wrapf(err, "Error decoding %s from docker", path)
+	}
+	return nil
+}
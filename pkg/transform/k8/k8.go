@@ -3,43 +3,92 @@ package k8
 import (
 	"os"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/wearefair/log-aggregator/pkg/types"
 )
 
 const (
-	CONTAINER_NAME                = "CONTAINER_NAME"
-	CONTAINER_ID_FULL             = "CONTAINER_ID_FULL"
+	CONTAINER_NAME    = "CONTAINER_NAME"
+	CONTAINER_ID_FULL = "CONTAINER_ID_FULL"
+	// Fields set by the cri source
+	K8S_NAMESPACE      = "K8S_NAMESPACE"
+	K8S_POD_NAME       = "K8S_POD_NAME"
+	K8S_POD_UID        = "K8S_POD_UID"
+	K8S_CONTAINER_NAME = "K8S_CONTAINER_NAME"
+	// The cgroup of the process that wrote a journal entry
+	SYSTEMD_CGROUP                = "_SYSTEMD_CGROUP"
+	JD_SYSTEMD_CGROUP             = "JD_SYSTEMD_CGROUP"
+	DefaultDeletedPodGracePeriod  = time.Minute * 5
+	DefaultMissingPodTTL          = time.Second * 30
+	DefaultMultilineTimeout       = time.Second * 2
+	DefaultMultilineMaxSize       = 1024 * 1024
 	KubernetesContainerNameRegexp = `^k8s_(?P<container_name>[^\._]+)\.?[^_]*_(?P<pod_name>[^_]+)_(?P<namespace>[^_]+)_[^_]+_[a-f0-9]+$`
 )
 
+var (
+	cgroupPodRegexp       = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+	cgroupContainerRegexp = regexp.MustCompile(`/(?:[a-z]+(?:-[a-z]+)*-)?([0-9a-f]{64})(?:\.scope)?$`)
+)
+
 type Config struct {
 	KubernetesContainerNameRegexp string
 	K8ConfigPath                  string
 	NodeName                      string
 	MaxPodsCache                  int
+	// InCluster authenticates with the service account of the pod instead of K8ConfigPath.
+	InCluster bool
+	// DeletedPodGracePeriod is how long the metadata of deleted pods is kept, for their last logs.
+	DeletedPodGracePeriod time.Duration
+	// MissingPodTTL is how long pods that couldn't be found aren't looked up again, and how long
+	// namespaces that were looked up before the informer synced them are cached.
+	MissingPodTTL time.Duration
+	// KubeletURL is the kubelet to list pods from when the API server can't be reached, e.g. the
+	// read-only port http://localhost:10255. Disabled if empty.
+	KubeletURL string
+	// Annotations are the pod annotations that are added to records, e.g. team or cost-center.
+	Annotations []string
+	// MultilineTimeout is how long to wait for more lines of a multiline message.
+	MultilineTimeout time.Duration
+	// MultilineMaxSize is the largest message that lines are joined into.
+	MultilineMaxSize int
+	// DockerSocket is the Docker Engine API socket to look up the image and labels of containers, e.g.
+	// /var/run/docker.sock. Disabled if empty.
+	DockerSocket string
+	// DockerLabels are the container labels that are added to records.
+	DockerLabels []string
 }
 
 type Client struct {
 	containerNameRegex *regexp.Regexp
-	tracker            tracker
+	// Guards tracker, which is replaced when the credentials change.
+	lock        sync.RWMutex
+	tracker     tracker
+	annotations []string
+	multiline   *multilineBuffer
+	// Optional
+	docker *dockerClient
 }
 
 func New(conf Config) *Client {
-	// If the k8 config path doesn't exist, then we need to start a filesystem watcher
-	// to get notified when/if it does, so we can provision the tracker.
-	if _, err := os.Stat(conf.K8ConfigPath); os.IsNotExist(err) {
-		client := NewWithTracker(nil, conf)
-		go watchForK8ConfigFile(client, conf)
-		return client
-	}
-	// File might exist, proceed normally.
-	tracker, err := newTracker(conf)
-	if err != nil {
-		panic(err)
+	client := NewWithTracker(nil, conf)
+	files := credentialFiles(conf)
+	loaded := readCredentials(files)
+	// If the credentials don't exist yet, the tracker is created by the watcher once they do.
+	if _, err := os.Stat(files[0].path); !os.IsNotExist(err) {
+		tracker, err := newTracker(conf)
+		if err != nil {
+			panic(err)
+		}
+		client.setTracker(tracker)
 	}
-	return NewWithTracker(tracker, conf)
+	go watchCredentials(client, files, loaded, func() (tracker, error) {
+		return newTracker(conf)
+	})
+	return client
 }
 
 func NewWithTracker(tracker tracker, conf Config) *Client {
@@ -53,53 +102,211 @@ func NewWithTracker(tracker tracker, conf Config) *Client {
 		panic(errors.Wrapf(err, "Error compiling kubernetes container name regex: %s", regex))
 	}
 
+	multilineTimeout := DefaultMultilineTimeout
+	if conf.MultilineTimeout != 0 {
+		multilineTimeout = conf.MultilineTimeout
+	}
+	multilineMaxSize := DefaultMultilineMaxSize
+	if conf.MultilineMaxSize != 0 {
+		multilineMaxSize = conf.MultilineMaxSize
+	}
+
+	var docker *dockerClient
+	if conf.DockerSocket != "" {
+		docker = newDockerClient(conf.DockerSocket, conf.DockerLabels)
+	}
+
 	return &Client{
 		containerNameRegex: compiled,
 		tracker:            tracker,
+		annotations:        conf.Annotations,
+		multiline:          newMultilineBuffer(multilineTimeout, multilineMaxSize),
+		docker:             docker,
 	}
 }
 
+func (c *Client) currentTracker() tracker {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.tracker
+}
+
+// setTracker replaces the tracker, and stops the previous one.
+func (c *Client) setTracker(tracker tracker) {
+	c.lock.Lock()
+	previous := c.tracker
+	c.tracker = tracker
+	c.lock.Unlock()
+	if previous != nil {
+		previous.Stop()
+	}
+}
+
+// Transform adds the pod metadata to a record, and processes it as configured by the pod annotations.
+// Records of excluded containers are dropped, and lines of multiline messages are held back until the
+// message is complete (see Flush).
 func (c *Client) Transform(rec *types.Record) (*types.Record, error) {
-	containerName, namePresent := rec.Fields[CONTAINER_NAME]
-	containerId, idPresent := rec.Fields[CONTAINER_ID_FULL]
+	cursor := rec.Cursor
+	transformed, err := c.transform(rec)
+	c.multiline.progress(cursor, transformed)
+	return transformed, err
+}
 
+func (c *Client) transform(rec *types.Record) (*types.Record, error) {
+	var metadata metadataKubernetes
+	var controls logControls
+	var pod *trackedPod
+	tracker := c.currentTracker()
+	containerName, namePresent := rec.Fields[CONTAINER_NAME].(string)
+	containerId, idPresent := rec.Fields[CONTAINER_ID_FULL].(string)
+	podName, podPresent := rec.Fields[K8S_POD_NAME].(string)
+	cgroup, cgroupPresent := rec.Fields[SYSTEMD_CGROUP].(string)
+	if !cgroupPresent {
+		// The journal transformer prefixes the field
+		cgroup, cgroupPresent = rec.Fields[JD_SYSTEMD_CGROUP].(string)
+	}
+
+	var matchFields map[string]string
 	if namePresent && idPresent {
+		matchFields = matchRegex(containerName, c.containerNameRegex)
+	}
 
-		matchFields := matchRegex(containerName.(string), c.containerNameRegex)
-		if matchFields != nil {
-			rec.Fields["docker"] = metadataDocker{
-				ContainerId: containerId.(string),
-			}
+	if matchFields != nil {
+		rec.Fields["docker"] = c.dockerMetadata(containerId)
 
-			var metadata metadataKubernetes
+		if val, ok := matchFields["namespace"]; ok {
+			metadata.NamespaceName = val
+		}
+		if val, ok := matchFields["pod_name"]; ok {
+			metadata.PodName = val
+		}
+		if val, ok := matchFields["container_name"]; ok {
+			metadata.ContainerName = val
+		}
+	} else if podPresent {
+		// Records from the cri source already carry the pod fields.
+		metadata.PodName = podName
+		metadata.NamespaceName, _ = rec.Fields[K8S_NAMESPACE].(string)
+		metadata.ContainerName, _ = rec.Fields[K8S_CONTAINER_NAME].(string)
+		metadata.PodId, _ = rec.Fields[K8S_POD_UID].(string)
+	} else if (idPresent || cgroupPresent) && tracker != nil {
+		// Containers that aren't named after their pod (e.g. by containerd or CRI-O) are found by ID.
+		pod, metadata.ContainerName = resolveContainer(tracker, containerId, cgroup)
+		if pod == nil {
+			return rec, nil
+		}
+		if idPresent {
+			rec.Fields["docker"] = c.dockerMetadata(containerId)
+		}
+		metadata.NamespaceName = pod.Namespace
+		metadata.PodName = pod.Name
+	} else {
+		return rec, nil
+	}
 
-			if val, ok := matchFields["namespace"]; ok {
-				metadata.NamespaceName = val
-			}
-			if val, ok := matchFields["pod_name"]; ok {
-				metadata.PodName = val
-			}
-			if val, ok := matchFields["container_name"]; ok {
-				metadata.ContainerName = val
+	// If we don't have a tracker then skip getting pod info
+	// The tracker can be setup after the fact
+	if tracker != nil {
+		if pod == nil {
+			pod = tracker.Get(metadata.NamespaceName, metadata.PodName)
+		}
+		if pod != nil {
+			if pod.ObjectMeta.UID != "" {
+				metadata.PodId = string(pod.ObjectMeta.UID)
 			}
+			metadata.Labels = pod.ObjectMeta.Labels
+			metadata.Node = pod.Spec.NodeName
+			metadata.WorkloadKind = pod.WorkloadKind
+			metadata.WorkloadName = pod.WorkloadName
+			metadata.Annotations = c.podAnnotations(pod.ObjectMeta.Annotations)
+			controls = pod.Controls.forContainer(metadata.ContainerName)
+		}
+		namespace := tracker.Namespace(metadata.NamespaceName)
+		if namespace != nil {
+			metadata.NamespaceId = string(namespace.ObjectMeta.UID)
+			metadata.NamespaceLabels = namespace.ObjectMeta.Labels
+		}
+	}
 
-			// If we don't have a tracker then skip getting pod info
-			// The tracker can be setup after the fact
-			if c.tracker != nil {
-				pod := c.tracker.Get(metadata.NamespaceName, metadata.PodName)
-				if pod != nil {
-					metadata.PodId = string(pod.ObjectMeta.UID)
-					metadata.Labels = pod.ObjectMeta.Labels
-					metadata.Node = pod.Spec.NodeName
-				}
-			}
+	if controls.Exclude {
+		return nil, nil
+	}
+	metadata.Destination = controls.Destination
+	rec.Fields["kubernetes"] = metadata
 
-			rec.Fields["kubernetes"] = metadata
-		}
+	if controls.Multiline != nil {
+		key := metadata.NamespaceName + "_" + metadata.PodName + "_" + metadata.ContainerName
+		return c.multiline.add(key, rec, controls.Multiline, controls.Parser, time.Now()), nil
+	}
+	if controls.Parser != "" {
+		parse(rec, controls.Parser)
 	}
 	return rec, nil
 }
 
+// Flush implements transform.Flusher, returning the multiline messages that timed out.
+func (c *Client) Flush(now time.Time) []*types.Record {
+	return c.multiline.Flush(now)
+}
+
+// dockerMetadata returns the Docker metadata of a container, looking it up if a socket is configured.
+func (c *Client) dockerMetadata(containerId string) metadataDocker {
+	if c.docker == nil {
+		return metadataDocker{ContainerId: containerId}
+	}
+	return c.docker.container(containerId)
+}
+
+// resolveContainer finds the pod of a container by its ID, or by the pod UID and container ID in its
+// cgroup path. The container name is empty if only the pod was found.
+func resolveContainer(tracker tracker, containerId, cgroup string) (*trackedPod, string) {
+	podUID, cgroupContainerId := parseCgroup(cgroup)
+	if containerId == "" {
+		containerId = cgroupContainerId
+	}
+	if containerId != "" {
+		if pod, name := tracker.ByContainerID(containerId); pod != nil {
+			return pod, name
+		}
+	}
+	if podUID != "" {
+		return tracker.ByUID(podUID), ""
+	}
+	return nil, ""
+}
+
+// parseCgroup extracts the pod UID and container ID from a kubernetes cgroup path, e.g.
+// /kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod<uid>.slice/cri-containerd-<id>.scope
+// or /kubepods/burstable/pod<uid>/<id>
+func parseCgroup(cgroup string) (string, string) {
+	if !strings.Contains(cgroup, "kubepods") {
+		return "", ""
+	}
+	var podUID, containerId string
+	if match := cgroupPodRegexp.FindStringSubmatch(cgroup); match != nil {
+		// The systemd cgroup driver replaces dashes with underscores
+		podUID = strings.Replace(match[1], "_", "-", -1)
+	}
+	if match := cgroupContainerRegexp.FindStringSubmatch(cgroup); match != nil {
+		containerId = match[1]
+	}
+	return podUID, containerId
+}
+
+// podAnnotations returns the allowed annotations of a pod.
+func (c *Client) podAnnotations(annotations map[string]string) map[string]string {
+	var allowed map[string]string
+	for _, name := range c.annotations {
+		if value, ok := annotations[name]; ok {
+			if allowed == nil {
+				allowed = make(map[string]string)
+			}
+			allowed[name] = value
+		}
+	}
+	return allowed
+}
+
 func matchRegex(input string, regex *regexp.Regexp) map[string]string {
 	match := regex.FindStringSubmatch(input)
 	if match == nil {
@@ -116,15 +323,24 @@ func matchRegex(input string, regex *regexp.Regexp) map[string]string {
 }
 
 type metadataDocker struct {
-	ContainerId string `json:"container_id,omitempty"`
+	ContainerId   string            `json:"container_id,omitempty"`
+	ContainerName string            `json:"container_name,omitempty"`
+	Image         string            `json:"image,omitempty"`
+	ImageDigest   string            `json:"image_digest,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
 }
 
 type metadataKubernetes struct {
-	NamespaceName string            `json:"namespace_name,omitempty"`
-	NamespaceId   string            `json:"namespace_id,omitempty"`
-	PodName       string            `json:"pod_name,omitempty"`
-	PodId         string            `json:"pod_id,omitempty"`
-	ContainerName string            `json:"container_name,omitempty"`
-	Node          string            `json:"node,omitempty"`
-	Labels        map[string]string `json:"labels,omitempty"`
+	NamespaceName   string            `json:"namespace_name,omitempty"`
+	NamespaceId     string            `json:"namespace_id,omitempty"`
+	NamespaceLabels map[string]string `json:"namespace_labels,omitempty"`
+	PodName         string            `json:"pod_name,omitempty"`
+	PodId           string            `json:"pod_id,omitempty"`
+	ContainerName   string            `json:"container_name,omitempty"`
+	Node            string            `json:"node,omitempty"`
+	WorkloadKind    string            `json:"workload_kind,omitempty"`
+	WorkloadName    string            `json:"workload_name,omitempty"`
+	Destination     string            `json:"destination,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
 }
@@ -1,14 +1,28 @@
 package k8
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/wearefair/log-aggregator/pkg/types"
 
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8types "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestMatchRegex(t *testing.T) {
@@ -125,6 +139,379 @@ func TestTransform(t *testing.T) {
 	checkPodMetadata1_6(t, transformed)
 }
 
+func TestTransformCRI(t *testing.T) {
+	track := &mockTracker{
+		pods: map[string]*v1.Pod{
+			"namespacename_podname": {
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      map[string]string{"label1": "value1"},
+					Annotations: map[string]string{"team": "payments", "other": "x"},
+				},
+				Spec: v1.PodSpec{NodeName: "myhost"},
+			},
+		},
+		namespaces: map[string]*v1.Namespace{
+			"namespacename": {
+				ObjectMeta: metav1.ObjectMeta{UID: k8types.UID("namespaceuid"), Labels: map[string]string{"env": "prod"}},
+			},
+		},
+		workloadKind: "Deployment",
+		workloadName: "web",
+	}
+	k8 := NewWithTracker(track, Config{Annotations: []string{"team", "cost-center"}})
+
+	rec := &types.Record{
+		Fields: map[string]interface{}{
+			"K8S_NAMESPACE":      "namespacename",
+			"K8S_POD_NAME":       "podname",
+			"K8S_POD_UID":        "poduid",
+			"K8S_CONTAINER_NAME": "containername",
+		},
+	}
+	transformed, _ := k8.Transform(rec)
+	metadata := transformed.Fields["kubernetes"].(metadataKubernetes)
+	if metadata.NamespaceName != "namespacename" || metadata.PodName != "podname" || metadata.ContainerName != "containername" {
+		t.Errorf("Expected pod fields to be copied, but got %+v", metadata)
+	}
+	if metadata.PodId != "poduid" {
+		t.Errorf("Expected PodId to be poduid, but got %s", metadata.PodId)
+	}
+	if metadata.Node != "myhost" || metadata.Labels["label1"] != "value1" {
+		t.Errorf("Expected metadata from the tracker, but got %+v", metadata)
+	}
+	if metadata.WorkloadKind != "Deployment" || metadata.WorkloadName != "web" {
+		t.Errorf("Expected the workload from the tracker, but got %+v", metadata)
+	}
+	if metadata.NamespaceId != "namespaceuid" || metadata.NamespaceLabels["env"] != "prod" {
+		t.Errorf("Expected namespace metadata from the tracker, but got %+v", metadata)
+	}
+	if expected := map[string]string{"team": "payments"}; !reflect.DeepEqual(metadata.Annotations, expected) {
+		t.Errorf("Expected annotations %v, but got %v", expected, metadata.Annotations)
+	}
+	if _, ok := transformed.Fields["docker"]; ok {
+		t.Errorf("Did not expect docker metadata without a container id")
+	}
+}
+
+func TestTrackWorkload(t *testing.T) {
+	controller := true
+	ownedBy := func(kind, name string) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{Kind: kind, Name: name, UID: k8types.UID(kind + "-" + name), Controller: &controller}}
+	}
+	client := fake.NewSimpleClientset(
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default", Name: "web-2957857213", OwnerReferences: ownedBy("Deployment", "web"),
+		}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default", Name: "report-1572870600", OwnerReferences: ownedBy("CronJob", "report"),
+		}},
+	)
+	tracker := newPodTracker(client, "", 10)
+
+	testCases := []struct {
+		owners       []metav1.OwnerReference
+		expectedKind string
+		expectedName string
+	}{
+		{ownedBy("ReplicaSet", "web-2957857213"), "Deployment", "web"},
+		{ownedBy("Job", "report-1572870600"), "CronJob", "report"},
+		{ownedBy("StatefulSet", "db"), "StatefulSet", "db"},
+		// Owners that can't be found are the workload themselves.
+		{ownedBy("ReplicaSet", "missing"), "ReplicaSet", "missing"},
+		{nil, "", ""},
+	}
+	for index, testCase := range testCases {
+		pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod", OwnerReferences: testCase.owners}}
+		tracked := tracker.track(pod)
+		if tracked.WorkloadKind != testCase.expectedKind || tracked.WorkloadName != testCase.expectedName {
+			t.Errorf("Expected workload %s/%s in test case %d, but got %s/%s", testCase.expectedKind,
+				testCase.expectedName, index, tracked.WorkloadKind, tracked.WorkloadName)
+		}
+	}
+}
+
+func TestTransformControls(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				AnnotationParser:                      ParserLogfmt,
+				AnnotationParser + ".nginx":           ParserNginx,
+				AnnotationExclude + ".sidecar":        "true",
+				AnnotationMultilinePattern + ".java":  `^\d{4}-`,
+				AnnotationDestination:                 "team-payments",
+				AnnotationDestination + ".unexpected": "ignored",
+			},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{Name: "app"}, {Name: "nginx"}, {Name: "sidecar"}, {Name: "java"}},
+		},
+	}
+	k8 := NewWithTracker(&mockTracker{pods: map[string]*v1.Pod{"default_web": pod}}, Config{MultilineTimeout: time.Second})
+	record := func(container, log string) *types.Record {
+		return &types.Record{
+			Cursor: types.Cursor(log),
+			Fields: map[string]interface{}{
+				"K8S_NAMESPACE":      "default",
+				"K8S_POD_NAME":       "web",
+				"K8S_CONTAINER_NAME": container,
+				"log":                log,
+			},
+		}
+	}
+
+	transformed, _ := k8.Transform(record("app", `level=info msg="hello world" user=42 cached`))
+	expected := map[string]interface{}{"level": "info", "msg": "hello world", "user": "42", "cached": "true"}
+	for k, v := range expected {
+		if transformed.Fields[k] != v {
+			t.Errorf("Expected logfmt field %s to be %v, but got %v", k, v, transformed.Fields[k])
+		}
+	}
+	if val := transformed.Fields["kubernetes"].(metadataKubernetes).Destination; val != "team-payments" {
+		t.Errorf("Expected Destination to be team-payments, but got %s", val)
+	}
+
+	transformed, _ = k8.Transform(record("nginx", `10.0.0.1 - - [04/Nov/2019:12:30:00 +0000] "GET /health HTTP/1.1" 200 2 "-" "kube-probe/1.15"`))
+	if transformed.Fields["status"] != "200" || transformed.Fields["path"] != "/health" || transformed.Fields["http_user_agent"] != "kube-probe/1.15" {
+		t.Errorf("Expected nginx fields, but got %v", transformed.Fields)
+	}
+	if !transformed.Time.Equal(time.Date(2019, 11, 4, 12, 30, 0, 0, time.UTC)) {
+		t.Errorf("Expected the time of the request, but got %s", transformed.Time)
+	}
+
+	if transformed, _ = k8.Transform(record("sidecar", "noise")); transformed != nil {
+		t.Errorf("Expected records of excluded containers to be dropped, but got %v", transformed.Fields)
+	}
+
+	// Lines are held until the next message starts, or until they time out.
+	lines := []string{"2019-11-04 Exception", "  at Foo", "  at Bar", "2019-11-04 Next"}
+	var joined []*types.Record
+	for _, line := range lines {
+		if transformed, _ = k8.Transform(record("java", line)); transformed != nil {
+			joined = append(joined, transformed)
+		}
+	}
+	if len(joined) != 1 || joined[0].Fields["log"] != "2019-11-04 Exception\n  at Foo\n  at Bar" {
+		t.Fatalf("Expected a joined message, but got %v", joined)
+	}
+	if joined[0].Cursor != "  at Bar" {
+		t.Errorf("Expected the cursor of the last line, but got %s", joined[0].Cursor)
+	}
+
+	// Records that are sent while a message is held don't move the cursor past it.
+	transformed, _ = k8.Transform(record("app", "after"))
+	if transformed.Cursor != "  at Bar" {
+		t.Errorf("Expected the cursor from before the held message, but got %s", transformed.Cursor)
+	}
+	if flushed := k8.Flush(time.Now()); len(flushed) != 0 {
+		t.Errorf("Did not expect messages to be flushed before the timeout, but got %d", len(flushed))
+	}
+	flushed := k8.Flush(time.Now().Add(time.Second))
+	if len(flushed) != 1 || flushed[0].Fields["log"] != "2019-11-04 Next" {
+		t.Fatalf("Expected the held message to be flushed, but got %v", flushed)
+	}
+	if flushed[0].Cursor != "after" {
+		t.Errorf("Expected the cursor of the last record, but got %s", flushed[0].Cursor)
+	}
+}
+
+func TestKubeletFallback(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/pods" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(v1.PodList{Items: []v1.Pod{
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: k8types.UID("webuid")}},
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "db", UID: k8types.UID("dbuid")}},
+		}})
+	}))
+	defer server.Close()
+
+	// The fake API server doesn't know any pods.
+	tracker := newPodTracker(fake.NewSimpleClientset(), "node", 10)
+	tracker.kubelet = newKubeletClient(server.URL + "/")
+
+	if pod := tracker.Get("default", "web"); pod == nil || pod.UID != "webuid" {
+		t.Errorf("Expected the pod from the kubelet, but got %v", pod)
+	}
+	if pod := tracker.Get("default", "db"); pod == nil || pod.UID != "dbuid" {
+		t.Errorf("Expected the other pods of the kubelet to be cached, but got %v", pod)
+	}
+	if pod := tracker.Get("default", "missing"); pod != nil {
+		t.Errorf("Expected an unknown pod to be missing, but got %v", pod)
+	}
+	if requests != 1 {
+		t.Errorf("Expected the kubelet to be asked once, but got %d requests", requests)
+	}
+}
+
+func TestDeletedAndMissingPods(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	tracker := newPodTracker(client, "", 10)
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "job", Labels: map[string]string{"app": "job"}},
+		Spec:       v1.PodSpec{NodeName: "node"},
+	}
+
+	// Deleted pods are kept for the grace period.
+	tracker.OnAdd(pod)
+	tracker.OnDelete(pod)
+	if tracked := tracker.Get("default", "job"); tracked == nil || tracked.Labels["app"] != "job" {
+		t.Errorf("Expected the deleted pod, but got %v", tracked)
+	}
+	if len(client.Actions()) != 0 {
+		t.Errorf("Did not expect API requests for a deleted pod, but got %v", client.Actions())
+	}
+
+	// Afterwards they are missing, which is remembered.
+	now = now.Add(DefaultDeletedPodGracePeriod)
+	if tracked := tracker.Get("default", "job"); tracked != nil {
+		t.Errorf("Expected the pod to be missing after the grace period, but got %v", tracked)
+	}
+	tracker.Get("default", "job")
+	if len(client.Actions()) != 1 {
+		t.Errorf("Expected a single API request for a missing pod, but got %v", client.Actions())
+	}
+	now = now.Add(DefaultMissingPodTTL)
+	tracker.Get("default", "job")
+	if len(client.Actions()) != 2 {
+		t.Errorf("Expected missing pods to be looked up again after the TTL, but got %v", client.Actions())
+	}
+
+	// A new pod with the same name replaces them.
+	tracker.OnAdd(pod)
+	if tracked := tracker.Get("default", "job"); tracked == nil {
+		t.Errorf("Expected the added pod")
+	}
+}
+
+func TestNamespaceFallback(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+	tracker := newPodTracker(client, "", 10)
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
+
+	// Namespaces that aren't in the informer are looked up from the API once per TTL.
+	for i := 0; i < 3; i++ {
+		if namespace := tracker.Namespace("default"); namespace == nil || namespace.Name != "default" {
+			t.Errorf("Expected the default namespace, but got %v", namespace)
+		}
+		if namespace := tracker.Namespace("missing"); namespace != nil {
+			t.Errorf("Expected the namespace to be missing, but got %v", namespace)
+		}
+	}
+	if len(client.Actions()) != 2 {
+		t.Errorf("Expected a single API request per namespace, but got %v", client.Actions())
+	}
+	now = now.Add(DefaultMissingPodTTL)
+	tracker.Namespace("missing")
+	if len(client.Actions()) != 3 {
+		t.Errorf("Expected namespaces to be looked up again after the TTL, but got %v", client.Actions())
+	}
+}
+
+func TestTransformByContainerID(t *testing.T) {
+	containerID := strings.Repeat("ab", 32)
+	track := &mockTracker{
+		pods: map[string]*v1.Pod{
+			"default_web": {
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default", Name: "web", UID: k8types.UID("0c7b7e8a-1f2b-4c3d-9e8f-0123456789ab"),
+					Labels: map[string]string{"app": "web"},
+				},
+				Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{
+					{Name: "nginx", ContainerID: "containerd://" + containerID},
+				}},
+			},
+		},
+	}
+	k8 := NewWithTracker(track, Config{})
+
+	testCases := []struct {
+		fields        map[string]interface{}
+		containerName string
+	}{
+		// Container names that don't follow the Docker format
+		{map[string]interface{}{"CONTAINER_NAME": "nginx", "CONTAINER_ID_FULL": containerID}, "nginx"},
+		// Container cgroups of the systemd and cgroupfs drivers
+		{map[string]interface{}{"JD_SYSTEMD_CGROUP": "/kubepods.slice/kubepods-burstable.slice/" +
+			"kubepods-burstable-pod0c7b7e8a_1f2b_4c3d_9e8f_0123456789ab.slice/cri-containerd-" + containerID + ".scope"}, "nginx"},
+		{map[string]interface{}{"_SYSTEMD_CGROUP": "/kubepods/burstable/pod0c7b7e8a-1f2b-4c3d-9e8f-0123456789ab/" + containerID}, "nginx"},
+		// Unknown containers of a known pod
+		{map[string]interface{}{"_SYSTEMD_CGROUP": "/kubepods/pod0c7b7e8a-1f2b-4c3d-9e8f-0123456789ab/" + strings.Repeat("cd", 32)}, ""},
+	}
+	for index, testCase := range testCases {
+		transformed, _ := k8.Transform(&types.Record{Fields: testCase.fields})
+		metadata, ok := transformed.Fields["kubernetes"].(metadataKubernetes)
+		if !ok {
+			t.Errorf("Expected metadata in test case %d, but got %v", index, transformed.Fields)
+			continue
+		}
+		if metadata.PodName != "web" || metadata.NamespaceName != "default" || metadata.Labels["app"] != "web" {
+			t.Errorf("Expected pod metadata in test case %d, but got %+v", index, metadata)
+		}
+		if metadata.ContainerName != testCase.containerName {
+			t.Errorf("Expected container %s in test case %d, but got %s", testCase.containerName, index, metadata.ContainerName)
+		}
+	}
+
+	transformed, _ := k8.Transform(&types.Record{Fields: map[string]interface{}{"_SYSTEMD_CGROUP": "/system.slice/sshd.service"}})
+	if _, ok := transformed.Fields["kubernetes"]; ok {
+		t.Errorf("Did not expect metadata for a process outside of kubernetes")
+	}
+}
+
+func TestTrackContainers(t *testing.T) {
+	tracker := newPodTracker(fake.NewSimpleClientset(), "", 10)
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: k8types.UID("webuid")},
+		Spec:       v1.PodSpec{NodeName: "node"},
+	}
+	tracker.OnAdd(pod)
+	// Container IDs are only known once the containers were created.
+	started := pod.DeepCopy()
+	started.Status.ContainerStatuses = []v1.ContainerStatus{{Name: "nginx", ContainerID: "cri-o://abcd"}}
+	tracker.OnUpdate(pod, started)
+
+	if tracked, name := tracker.ByContainerID("abcd"); tracked == nil || tracked.Name != "web" || name != "nginx" {
+		t.Errorf("Expected the pod of the container, but got %v %s", tracked, name)
+	}
+	if tracked := tracker.ByUID("webuid"); tracked == nil || tracked.Name != "web" {
+		t.Errorf("Expected the pod of the UID, but got %v", tracked)
+	}
+
+	// Deleted pods are found for the grace period, like by name.
+	tracker.OnDelete(started)
+	now = now.Add(DefaultDeletedPodGracePeriod - time.Second)
+	if tracked, _ := tracker.ByContainerID("abcd"); tracked == nil {
+		t.Errorf("Expected the deleted pod of the container")
+	}
+	if tracked := tracker.ByUID("webuid"); tracked == nil {
+		t.Errorf("Expected the deleted pod of the UID")
+	}
+	now = now.Add(time.Second)
+	if tracked, _ := tracker.ByContainerID("abcd"); tracked != nil {
+		t.Errorf("Expected the container to expire with its pod, but got %v", tracked)
+	}
+	if tracked := tracker.ByUID("webuid"); tracked != nil {
+		t.Errorf("Expected the UID to expire with its pod, but got %v", tracked)
+	}
+}
+
+func TestParseLogfmt(t *testing.T) {
+	fields := parseLogfmt(`a=1 b="quoted \"value\"" c= d e=x=y f=`)
+	expected := map[string]string{"a": "1", "b": `quoted "value"`, "c": "", "d": "true", "e": "x=y", "f": ""}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Expected %v, but got %v", expected, fields)
+	}
+}
+
 func checkPodMetadata(t *testing.T, transformed *types.Record) {
 	if val := transformed.Fields["docker"].(metadataDocker).ContainerId; val != "mycontainerid" {
 		t.Errorf("Expected container id to be %s, but got %s", "mycontainerid", val)
@@ -173,13 +560,192 @@ func checkPodMetadata1_6(t *testing.T, transformed *types.Record) {
 	}
 }
 
+func TestWatchCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kubelet.conf")
+	if err := ioutil.WriteFile(path, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	token := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(token, []byte("t1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := []credentialFile{{path: path, contents: true}, {path: token}}
+
+	first := &mockTracker{}
+	k8 := NewWithTracker(nil, Config{})
+	k8.setTracker(first)
+	built := make(chan *mockTracker, 10)
+	go watchCredentials(k8, files, readCredentials(files), func() (tracker, error) {
+		tracker := &mockTracker{}
+		built <- tracker
+		return tracker, nil
+	})
+	// Give the watcher time to start
+	time.Sleep(time.Millisecond * 100)
+
+	// Touching the directory without changing the credentials keeps the tracker.
+	if err := ioutil.WriteFile(filepath.Join(dir, "other"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// So does rotating the token, which client-go reads again itself.
+	if err := ioutil.WriteFile(token, []byte("t2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-built:
+		t.Errorf("Did not expect a tracker for a rotated token")
+	case <-time.After(time.Millisecond * 100):
+	}
+	// Credentials are usually rotated by replacing the file.
+	if err := ioutil.WriteFile(path+".tmp", []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case second := <-built:
+		deadline := time.Now().Add(time.Second)
+		for (k8.currentTracker() != second || atomic.LoadInt32(&first.stopped) == 0) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond * 10)
+		}
+		if k8.currentTracker() != second {
+			t.Errorf("Expected the tracker to be replaced")
+		}
+		if atomic.LoadInt32(&first.stopped) == 0 {
+			t.Errorf("Expected the previous tracker to be stopped")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected a new tracker after the credentials changed")
+	}
+	select {
+	case <-built:
+		t.Errorf("Did not expect a tracker for unchanged credentials")
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestDockerMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/containers/mycontainerid/json":
+			w.Write([]byte(`{"Name":"/k8s_mycontainer_mypod_mynamespace_0_1","Image":"sha256:abc",` +
+				`"Config":{"Image":"nginx:1.17","Labels":{"team":"web","other":"x"}}}`))
+		case "/images/sha256:abc/json":
+			w.Write([]byte(`{"RepoDigests":["nginx@sha256:def"]}`))
+		case "/containers/error/json":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	k8 := NewWithTracker(&mockTracker{}, Config{DockerSocket: socket, DockerLabels: []string{"team"}})
+	record := func() *types.Record {
+		transformed, err := k8.Transform(&types.Record{Fields: map[string]interface{}{
+			CONTAINER_NAME:    "k8s_mycontainer_mypod_mynamespace_0_1",
+			CONTAINER_ID_FULL: "mycontainerid",
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return transformed
+	}
+
+	expected := metadataDocker{
+		ContainerId:   "mycontainerid",
+		ContainerName: "k8s_mycontainer_mypod_mynamespace_0_1",
+		Image:         "nginx:1.17",
+		ImageDigest:   "sha256:def",
+		Labels:        map[string]string{"team": "web"},
+	}
+	if docker := record().Fields["docker"]; !reflect.DeepEqual(docker, expected) {
+		t.Errorf("Expected %+v, but got %+v", expected, docker)
+	}
+	record()
+	if val := atomic.LoadInt32(&requests); val != 2 {
+		t.Errorf("Expected the container to be looked up once, but got %d requests", val)
+	}
+
+	// Containers that docker doesn't know are cached, other errors only for a while.
+	now := time.Now()
+	k8.docker.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		k8.docker.container("unknown")
+		k8.docker.container("error")
+	}
+	if val := atomic.LoadInt32(&requests); val != 4 {
+		t.Errorf("Expected the containers to be looked up once, but got %d requests", val-2)
+	}
+	now = now.Add(dockerErrorTTL)
+	k8.docker.container("unknown")
+	k8.docker.container("error")
+	if val := atomic.LoadInt32(&requests); val != 5 {
+		t.Errorf("Expected the failed container to be looked up again, but got %d requests", val-4)
+	}
+}
+
 type mockTracker struct {
-	pods map[string]*v1.Pod
+	pods         map[string]*v1.Pod
+	namespaces   map[string]*v1.Namespace
+	workloadKind string
+	workloadName string
+	stopped      int32
 }
 
-func (t *mockTracker) Get(namespaceName, podName string) *v1.Pod {
+func (t *mockTracker) Get(namespaceName, podName string) *trackedPod {
 	if pod, ok := t.pods[namespaceName+"_"+podName]; ok {
-		return pod
+		return &trackedPod{Pod: pod, WorkloadKind: t.workloadKind, WorkloadName: t.workloadName, Controls: parseControls(pod)}
+	}
+	return nil
+}
+
+func (t *mockTracker) Namespace(namespaceName string) *v1.Namespace {
+	return t.namespaces[namespaceName]
+}
+
+// ByContainerID finds pods by the container ID in their status.
+func (t *mockTracker) ByContainerID(containerID string) (*trackedPod, string) {
+	for _, pod := range t.pods {
+		for _, status := range pod.Status.ContainerStatuses {
+			if trimRuntime(status.ContainerID) == containerID {
+				return t.Get(pod.Namespace, pod.Name), status.Name
+			}
+		}
+	}
+	return nil, ""
+}
+
+func (t *mockTracker) ByUID(uid string) *trackedPod {
+	for _, pod := range t.pods {
+		if string(pod.UID) == uid {
+			return t.Get(pod.Namespace, pod.Name)
+		}
 	}
 	return nil
 }
+
+func (t *mockTracker) Stop() {
+	atomic.StoreInt32(&t.stopped, 1)
+}
@@ -0,0 +1,60 @@
+package k8
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	kubeletTimeout = time.Second * 5
+	// The pods of the node are listed at most this often, so that lookups of unknown pods don't flood
+	// the kubelet.
+	kubeletMinInterval = time.Second * 10
+)
+
+// kubeletClient lists the pods of the node from the kubelet's /pods endpoint (e.g. on the read-only
+// port), which keeps working when the API server can't be reached.
+type kubeletClient struct {
+	sync.Mutex
+	url       string
+	client    *http.Client
+	lastFetch time.Time
+}
+
+func newKubeletClient(url string) *kubeletClient {
+	return &kubeletClient{
+		url:    strings.TrimSuffix(url, "/") + "/pods",
+		client: &http.Client{Timeout: kubeletTimeout},
+	}
+}
+
+// pods lists the pods of the node, or returns nil if they were listed recently.
+func (k *kubeletClient) pods(now time.Time) ([]v1.Pod, error) {
+	k.Lock()
+	if now.Sub(k.lastFetch) < kubeletMinInterval {
+		k.Unlock()
+		return nil, nil
+	}
+	k.lastFetch = now
+	k.Unlock()
+
+	resp, err := k.client.Get(k.url)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing pods from the kubelet")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Error listing pods from the kubelet: %s", resp.Status)
+	}
+	var pods v1.PodList
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, errors.Wrap(err, "Error decoding pods from the kubelet")
+	}
+	return pods.Items, nil
+}
@@ -0,0 +1,122 @@
+package k8
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+// multilineBuffer joins the lines of multiline messages (e.g. stack traces) of each container. A line
+// that matches the pattern starts a new message, and the following lines that don't are appended to
+// it. A message is held until the next one starts, or until it hasn't changed for the timeout.
+//
+// Records that are sent while messages are held carry the cursor from before the oldest held message,
+// so that resuming from the committed cursor repeats held messages instead of losing them.
+type multilineBuffer struct {
+	sync.Mutex
+	timeout time.Duration
+	maxSize int
+	held    map[string]*heldMessage
+	// The cursor of the last record that was transformed, and the number of messages that were held.
+	cursor types.Cursor
+	seq    uint64
+}
+
+type heldMessage struct {
+	record  *types.Record
+	parser  string
+	updated time.Time
+	// The cursor of the record before the first line, and the order in which messages were held.
+	since types.Cursor
+	seq   uint64
+}
+
+func newMultilineBuffer(timeout time.Duration, maxSize int) *multilineBuffer {
+	return &multilineBuffer{
+		timeout: timeout,
+		maxSize: maxSize,
+		held:    make(map[string]*heldMessage),
+	}
+}
+
+// add adds a line of a container, and returns the previous message of the container if the line
+// completed it, or nil.
+func (b *multilineBuffer) add(key string, rec *types.Record, pattern *regexp.Regexp, parser string, now time.Time) *types.Record {
+	b.Lock()
+	defer b.Unlock()
+
+	held := b.held[key]
+	// Lines that don't start a message are appended to the held one. Anything else (including records
+	// without a log line) replaces it.
+	if line, ok := rec.Fields["log"].(string); ok && held != nil && !pattern.MatchString(line) {
+		if message, ok := held.record.Fields["log"].(string); ok && len(message)+len(line) < b.maxSize {
+			held.record.Fields["log"] = message + "\n" + line
+			// The message is only sent once it's complete, so it has to carry the position of its last line.
+			held.record.Cursor = rec.Cursor
+			held.updated = now
+			return nil
+		}
+	}
+	b.seq++
+	b.held[key] = &heldMessage{record: rec, parser: parser, updated: now, since: b.cursor, seq: b.seq}
+	return finish(held)
+}
+
+// progress is called for every record that was transformed (with its cursor before transforming), and
+// holds the cursor of the transformed record back to before the oldest held message.
+func (b *multilineBuffer) progress(cursor types.Cursor, rec *types.Record) {
+	b.Lock()
+	defer b.Unlock()
+	if cursor != "" {
+		b.cursor = cursor
+	}
+	if rec != nil {
+		b.holdBack(rec)
+	}
+}
+
+// holdBack sets the cursor of the oldest held message on a record.
+func (b *multilineBuffer) holdBack(rec *types.Record) {
+	var oldest *heldMessage
+	for _, held := range b.held {
+		if oldest == nil || held.seq < oldest.seq {
+			oldest = held
+		}
+	}
+	if oldest != nil {
+		rec.Cursor = oldest.since
+	}
+}
+
+// Flush implements transform.Flusher, returning the messages that haven't changed for the timeout.
+func (b *multilineBuffer) Flush(now time.Time) []*types.Record {
+	b.Lock()
+	defer b.Unlock()
+
+	var records []*types.Record
+	for key, held := range b.held {
+		if now.Sub(held.updated) >= b.timeout {
+			delete(b.held, key)
+			records = append(records, finish(held))
+		}
+	}
+	// Every record up to the last one that was transformed has been sent once nothing is held.
+	for _, rec := range records {
+		rec.Cursor = b.cursor
+		b.holdBack(rec)
+	}
+	return records
+}
+
+// finish parses a complete message.
+func finish(held *heldMessage) *types.Record {
+	if held == nil {
+		return nil
+	}
+	if held.parser != "" {
+		parse(held.record, held.parser)
+	}
+	return held.record
+}
@@ -1,109 +1,176 @@
 package k8
 
 import (
-	"path/filepath"
+	"strings"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/pkg/errors"
 	"github.com/wearefair/log-aggregator/pkg/logging"
 	"go.uber.org/zap"
-	fsnotify "gopkg.in/fsnotify/fsnotify.v1"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	kcache "k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
 	// Resync period for the kube controller loop.
 	resyncPeriod = 30 * time.Minute
+	// Number of owners (e.g. ReplicaSets) to cache the workload of.
+	maxOwnersCache = 100
+	// Number of namespaces to cache the API lookups of.
+	maxNamespacesCache = 100
+	// Containers to index per cached pod
+	containersPerPod = 4
 )
 
 type tracker interface {
-	Get(string, string) *v1.Pod
+	Get(string, string) *trackedPod
+	// ByContainerID returns the pod of a container, and the name of the container.
+	ByContainerID(string) (*trackedPod, string)
+	ByUID(string) *trackedPod
+	Namespace(string) *v1.Namespace
+	// Stop stops watching the API server, once the tracker is replaced.
+	Stop()
+}
+
+// trackedPod is a pod, with the workload that it belongs to.
+type trackedPod struct {
+	*v1.Pod
+	// The top level controller of the pod, e.g. a Deployment instead of its ReplicaSet
+	WorkloadKind string
+	WorkloadName string
+	// Processing options from the pod annotations
+	Controls podControls
 }
 
 type podTracker struct {
-	client *kubernetes.Clientset
+	client kubernetes.Interface
 
 	// The name of the node that we are running on.
 	NodeName string
 	cache    *lru.Cache
+	// Workloads by the UID of the pod owner they were resolved for.
+	owners *lru.Cache
+	// All namespaces, kept up to date by an informer.
+	namespaces kcache.Store
+	// Namespaces that were looked up from the API because they weren't in the informer, so that the
+	// API is asked at most once per missingTTL.
+	apiNamespaces *lru.Cache
+	// Fallback for pods that can't be read from the API server (optional)
+	kubelet *kubeletClient
+	// Deleted pods, kept for the logs they write while shutting down.
+	tombstones         *lru.Cache
+	deletedGracePeriod time.Duration
+	// Pods that couldn't be found, so that they aren't looked up for every record.
+	missing    *lru.Cache
+	missingTTL time.Duration
+	// Pods by container ID and by UID, for runtimes that don't name containers after their pod.
+	// The entries of deleted pods expire with their tombstones.
+	containers *lru.Cache
+	uids       *lru.Cache
+	now        func() time.Time
+	// Closed to stop the informers.
+	stop chan struct{}
+}
+
+// podContainer is a container of a pod. The zero expires never expires.
+type podContainer struct {
+	pod     *trackedPod
+	name    string
+	expires time.Time
+}
+
+// expiringNamespace is a cache entry that is only valid until it expires. A nil namespace marks a
+// missing namespace.
+type expiringNamespace struct {
+	namespace *v1.Namespace
+	expires   time.Time
+}
+
+// expiringPod is a cache entry that is only valid until it expires. A nil pod marks a missing pod,
+// and in the UID index the zero expires never expires.
+type expiringPod struct {
+	pod     *trackedPod
+	expires time.Time
 }
 
 func newTracker(conf Config) (tracker, error) {
-	k8, err := newK8(conf.K8ConfigPath)
+	k8, err := newK8(conf)
 	if err != nil {
 		return nil, err
 	}
 	tracker := newPodTracker(k8, conf.NodeName, conf.MaxPodsCache)
+	if conf.DeletedPodGracePeriod != 0 {
+		tracker.deletedGracePeriod = conf.DeletedPodGracePeriod
+	}
+	if conf.MissingPodTTL != 0 {
+		tracker.missingTTL = conf.MissingPodTTL
+	}
+	if conf.KubeletURL != "" {
+		tracker.kubelet = newKubeletClient(conf.KubeletURL)
+	}
 	tracker.watchForPods()
+	tracker.watchForNamespaces()
 	return tracker, nil
 }
 
-func watchForK8ConfigFile(client *Client, conf Config) {
-	watcher, err := fsnotify.NewWatcher()
+func newPodTracker(client kubernetes.Interface, nodeName string, maxPods int) *podTracker {
+	cache, err := lru.New(maxPods)
 	if err != nil {
 		panic(err)
 	}
-
-	err = watcher.Add(filepath.Dir(conf.K8ConfigPath))
+	owners, err := lru.New(maxOwnersCache)
 	if err != nil {
 		panic(err)
 	}
-
-	for {
-		select {
-		case event := <-watcher.Events:
-			logging.Logger.Info("Got event for file", zap.String("name", event.Name))
-			if event.Name == conf.K8ConfigPath {
-				logging.Logger.Info("Creating new tracker for k8 config file")
-				tracker, err := newTracker(conf)
-				if err != nil {
-					logging.Error(errors.Wrap(err, "Got error creating k8 tracker on fsnotify"))
-				} else {
-					client.tracker = tracker
-					watcher.Close()
-					return
-				}
-			}
-		}
+	tombstones, err := lru.New(maxPods)
+	if err != nil {
+		panic(err)
 	}
-}
-
-func newK8(k8ConfigPath string) (*kubernetes.Clientset, error) {
-	config, err := clientcmd.BuildConfigFromFlags("", k8ConfigPath)
+	missing, err := lru.New(maxPods)
 	if err != nil {
-		return nil, errors.Wrap(err, "error getting config from path")
+		panic(err)
 	}
-
-	// creates the clientset
-	clientset, err := kubernetes.NewForConfig(config)
+	containers, err := lru.New(maxPods * containersPerPod)
 	if err != nil {
-		return nil, errors.Wrap(err, "error constructing k8 client from config")
+		panic(err)
 	}
-	return clientset, nil
-}
-
-func newPodTracker(client *kubernetes.Clientset, nodeName string, maxPods int) *podTracker {
-	cache, err := lru.New(maxPods)
+	uids, err := lru.New(maxPods)
+	if err != nil {
+		panic(err)
+	}
+	apiNamespaces, err := lru.New(maxNamespacesCache)
 	if err != nil {
 		panic(err)
 	}
 	return &podTracker{
-		NodeName: nodeName,
-		cache:    cache,
-		client:   client,
+		NodeName:           nodeName,
+		cache:              cache,
+		owners:             owners,
+		apiNamespaces:      apiNamespaces,
+		tombstones:         tombstones,
+		deletedGracePeriod: DefaultDeletedPodGracePeriod,
+		missing:            missing,
+		missingTTL:         DefaultMissingPodTTL,
+		containers:         containers,
+		uids:               uids,
+		now:                time.Now,
+		stop:               make(chan struct{}),
+		client:             client,
 	}
 }
 
 func (t *podTracker) watchForPods() {
+	// Only watch the pods of our node, if we know it.
+	selector := fields.Everything()
+	if t.NodeName != "" {
+		selector = fields.OneTermEqualSelector("spec.nodeName", t.NodeName)
+	}
 	_, podController := kcache.NewInformer(
-		kcache.NewListWatchFromClient(t.client.CoreV1().RESTClient(), "pods", v1.NamespaceAll, fields.Everything()),
+		kcache.NewListWatchFromClient(t.client.CoreV1().RESTClient(), "pods", v1.NamespaceAll, selector),
 		&v1.Pod{},
 		resyncPeriod,
 		kcache.ResourceEventHandlerFuncs{
@@ -112,25 +179,215 @@ func (t *podTracker) watchForPods() {
 			UpdateFunc: t.OnUpdate,
 		},
 	)
-	go podController.Run(wait.NeverStop)
+	go podController.Run(t.stop)
 }
 
-func (t *podTracker) Get(namespaceName, podName string) *v1.Pod {
-	if val, ok := t.cache.Get(t.cacheKey(namespaceName, podName)); ok {
-		return val.(*v1.Pod)
+func (t *podTracker) watchForNamespaces() {
+	store, namespaceController := kcache.NewInformer(
+		kcache.NewListWatchFromClient(t.client.CoreV1().RESTClient(), "namespaces", v1.NamespaceAll, fields.Everything()),
+		&v1.Namespace{},
+		resyncPeriod,
+		kcache.ResourceEventHandlerFuncs{},
+	)
+	t.namespaces = store
+	go namespaceController.Run(t.stop)
+}
+
+func (t *podTracker) Stop() {
+	close(t.stop)
+}
+
+// Namespace returns a namespace from the informer, or from the API if it hasn't been synced yet.
+func (t *podTracker) Namespace(namespaceName string) *v1.Namespace {
+	if t.namespaces != nil {
+		if val, ok, err := t.namespaces.GetByKey(namespaceName); err == nil && ok {
+			return val.(*v1.Namespace)
+		}
+	}
+	now := t.now()
+	if val, ok := t.apiNamespaces.Get(namespaceName); ok && now.Before(val.(*expiringNamespace).expires) {
+		return val.(*expiringNamespace).namespace
 	}
+	namespace, err := t.client.CoreV1().Namespaces().Get(namespaceName, metav1.GetOptions{})
+	if err != nil {
+		namespace = nil
+	}
+	t.apiNamespaces.Add(namespaceName, &expiringNamespace{namespace: namespace, expires: now.Add(t.missingTTL)})
+	return namespace
+}
+
+func (t *podTracker) Get(namespaceName, podName string) *trackedPod {
+	key := t.cacheKey(namespaceName, podName)
+	if val, ok := t.cache.Get(key); ok {
+		return val.(*trackedPod)
+	}
+	now := t.now()
+	if val, ok := t.tombstones.Get(key); ok && now.Before(val.(*expiringPod).expires) {
+		return val.(*expiringPod).pod
+	}
+	if val, ok := t.missing.Get(key); ok && now.Before(val.(*expiringPod).expires) {
+		return nil
+	}
+
 	pod, err := t.client.CoreV1().Pods(namespaceName).Get(podName, metav1.GetOptions{})
 	if err == nil {
-		t.cache.ContainsOrAdd(t.cacheKey(namespaceName, podName), pod)
-		return pod
+		tracked := t.track(pod)
+		t.cacheAdd(key, tracked)
+		return tracked
+	}
+	if t.kubelet != nil && t.loadFromKubelet() {
+		if val, ok := t.cache.Get(key); ok {
+			return val.(*trackedPod)
+		}
 	}
+	t.missing.Add(key, &expiringPod{expires: now.Add(t.missingTTL)})
 	return nil
 }
 
+// ByContainerID returns the pod of a container, from the container IDs in the pod statuses.
+func (t *podTracker) ByContainerID(containerID string) (*trackedPod, string) {
+	container := t.container(containerID)
+	if container == nil && t.kubelet != nil && t.loadFromKubelet() {
+		container = t.container(containerID)
+	}
+	if container == nil {
+		return nil, ""
+	}
+	return container.pod, container.name
+}
+
+func (t *podTracker) ByUID(uid string) *trackedPod {
+	pod := t.uid(uid)
+	if pod == nil && t.kubelet != nil && t.loadFromKubelet() {
+		pod = t.uid(uid)
+	}
+	return pod
+}
+
+// container returns an indexed container, removing it if its pod was deleted too long ago.
+func (t *podTracker) container(containerID string) *podContainer {
+	val, ok := t.containers.Get(containerID)
+	if !ok {
+		return nil
+	}
+	container := val.(*podContainer)
+	if !container.expires.IsZero() && !t.now().Before(container.expires) {
+		t.containers.Remove(containerID)
+		return nil
+	}
+	return container
+}
+
+// uid returns an indexed pod, removing it if it was deleted too long ago.
+func (t *podTracker) uid(uid string) *trackedPod {
+	val, ok := t.uids.Get(uid)
+	if !ok {
+		return nil
+	}
+	indexed := val.(*expiringPod)
+	if !indexed.expires.IsZero() && !t.now().Before(indexed.expires) {
+		t.uids.Remove(uid)
+		return nil
+	}
+	return indexed.pod
+}
+
+// loadFromKubelet caches all the pods of the node from the kubelet, and returns whether any were loaded.
+func (t *podTracker) loadFromKubelet() bool {
+	pods, err := t.kubelet.pods(time.Now())
+	if err != nil {
+		logging.Error(err)
+		return false
+	}
+	for i := range pods {
+		pod := &pods[i]
+		key := t.cacheKey(pod.Namespace, pod.Name)
+		if !t.cache.Contains(key) {
+			t.cacheAdd(key, t.track(pod))
+		}
+	}
+	return len(pods) != 0
+}
+
+// cacheAdd caches a pod, and indexes it by UID and container IDs.
+func (t *podTracker) cacheAdd(key string, tracked *trackedPod) {
+	t.cache.Add(key, tracked)
+	t.index(tracked, time.Time{})
+}
+
+// index indexes a pod by UID and container IDs, until it expires.
+func (t *podTracker) index(tracked *trackedPod, expires time.Time) {
+	if tracked.UID != "" {
+		t.uids.Add(string(tracked.UID), &expiringPod{pod: tracked, expires: expires})
+	}
+	for _, statuses := range [][]v1.ContainerStatus{tracked.Status.InitContainerStatuses, tracked.Status.ContainerStatuses} {
+		for _, status := range statuses {
+			if id := trimRuntime(status.ContainerID); id != "" {
+				t.containers.Add(id, &podContainer{pod: tracked, name: status.Name, expires: expires})
+			}
+		}
+	}
+}
+
+// trimRuntime removes the runtime from a container ID, e.g. containerd://<id>
+func trimRuntime(containerID string) string {
+	if i := strings.Index(containerID, "://"); i >= 0 {
+		return containerID[i+3:]
+	}
+	return containerID
+}
+
+// track resolves the workload and processing options of a pod.
+func (t *podTracker) track(pod *v1.Pod) *trackedPod {
+	tracked := &trackedPod{Pod: pod, Controls: parseControls(pod)}
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return tracked
+	}
+	if val, ok := t.owners.Get(owner.UID); ok {
+		workload := val.(*metav1.OwnerReference)
+		tracked.WorkloadKind, tracked.WorkloadName = workload.Kind, workload.Name
+		return tracked
+	}
+
+	workload, err := t.resolveOwner(pod.Namespace, owner)
+	if err != nil {
+		// Use the owner for now, and try again next time.
+		logging.Error(err)
+		workload = owner
+	} else {
+		t.owners.Add(owner.UID, workload)
+	}
+	tracked.WorkloadKind, tracked.WorkloadName = workload.Kind, workload.Name
+	return tracked
+}
+
+// resolveOwner follows the owner chain of a pod's controller, from ReplicaSets to Deployments and
+// from Jobs to CronJobs. Other controllers (StatefulSets, DaemonSets, etc) are the workload themselves.
+func (t *podTracker) resolveOwner(namespaceName string, owner *metav1.OwnerReference) (*metav1.OwnerReference, error) {
+	var object metav1.Object
+	var err error
+	switch owner.Kind {
+	case "ReplicaSet":
+		object, err = t.client.AppsV1().ReplicaSets(namespaceName).Get(owner.Name, metav1.GetOptions{})
+	case "Job":
+		object, err = t.client.BatchV1().Jobs(namespaceName).Get(owner.Name, metav1.GetOptions{})
+	default:
+		return owner, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error getting %s %s/%s", owner.Kind, namespaceName, owner.Name)
+	}
+	if parent := metav1.GetControllerOf(object); parent != nil {
+		return parent, nil
+	}
+	return owner, nil
+}
+
 func (t *podTracker) OnAdd(obj interface{}) {
 	if pod, ok := obj.(*v1.Pod); ok {
 		if t.canTrackPod(pod) {
-			t.cache.Add(t.cacheKey(pod.Namespace, pod.Name), pod)
+			t.add(pod)
 			logging.Logger.Info("Pod added", zap.String("namespace", pod.Namespace), zap.String("pod", pod.Name))
 		}
 	}
@@ -146,7 +403,7 @@ func (t *podTracker) OnUpdate(oldObj, newObj interface{}) {
 		return
 	}
 	if t.canTrackPod(newPod) {
-		t.cache.Add(t.cacheKey(newPod.Namespace, newPod.Name), newPod)
+		t.add(newPod)
 		logging.Logger.Info("Pod updated", zap.String("namespace", newPod.Namespace), zap.String("pod", newPod.Name))
 	}
 }
@@ -164,10 +421,27 @@ func (t *podTracker) OnDelete(obj interface{}) {
 	if !ok {
 		return
 	}
-	t.cache.Remove(t.cacheKey(pod.Namespace, pod.Name))
+	// Keep the pod around for the logs that are still on their way.
+	key := t.cacheKey(pod.Namespace, pod.Name)
+	tracked, ok := t.cache.Get(key)
+	if !ok {
+		tracked = t.track(pod)
+	}
+	expires := t.now().Add(t.deletedGracePeriod)
+	t.tombstones.Add(key, &expiringPod{pod: tracked.(*trackedPod), expires: expires})
+	t.index(tracked.(*trackedPod), expires)
+	t.cache.Remove(key)
 	logging.Logger.Info("Pod deleted", zap.String("namespace", pod.Namespace), zap.String("pod", pod.Name))
 }
 
+// add caches a pod, replacing a deleted or missing pod with the same name.
+func (t *podTracker) add(pod *v1.Pod) {
+	key := t.cacheKey(pod.Namespace, pod.Name)
+	t.cacheAdd(key, t.track(pod))
+	t.tombstones.Remove(key)
+	t.missing.Remove(key)
+}
+
 func (t *podTracker) cacheKey(namespaceName, podName string) string {
 	return namespaceName + "_" + podName
 }
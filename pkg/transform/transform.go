@@ -1,5 +1,16 @@
 package transform
 
-import "github.com/wearefair/log-aggregator/pkg/types"
+import (
+	"time"
 
+	"github.com/wearefair/log-aggregator/pkg/types"
+)
+
+// Transformer changes a record. Returning a nil record drops it.
 type Transformer func(rec *types.Record) (*types.Record, error)
+
+// Flusher is implemented by transformers that hold records back, e.g. to join the lines of multiline
+// messages. Flush returns the held records that shouldn't wait any longer.
+type Flusher interface {
+	Flush(now time.Time) []*types.Record
+}
@@ -0,0 +1,99 @@
+package types
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Lookup returns the value found at a dot separated path within the record fields,
+// e.g. "kubernetes.namespace_name".
+//
+// Nested values can be maps with string keys, or structs (like the metadata attached by the
+// transformers), in which case the path segment is matched against the json tag of the field.
+func (r *Record) Lookup(path string) (interface{}, bool) {
+	if r == nil || r.Fields == nil || path == "" {
+		return nil, false
+	}
+	segments := strings.Split(path, ".")
+	value, ok := r.Fields[segments[0]]
+	if !ok {
+		return nil, false
+	}
+	for _, segment := range segments[1:] {
+		value, ok = lookupSegment(value, segment)
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// LookupString is like Lookup, but formats the value as a string.
+// Missing or nil values are returned as an empty string, and false.
+func (r *Record) LookupString(path string) (string, bool) {
+	value, ok := r.Lookup(path)
+	if !ok || value == nil {
+		return "", false
+	}
+	if str, ok := value.(string); ok {
+		return str, true
+	}
+	return fmt.Sprint(value), true
+}
+
+func lookupSegment(value interface{}, segment string) (interface{}, bool) {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		val, ok := typed[segment]
+		return val, ok
+	case map[string]string:
+		val, ok := typed[segment]
+		return val, ok
+	}
+
+	reflected := reflect.ValueOf(value)
+	for reflected.Kind() == reflect.Ptr || reflected.Kind() == reflect.Interface {
+		if reflected.IsNil() {
+			return nil, false
+		}
+		reflected = reflected.Elem()
+	}
+
+	switch reflected.Kind() {
+	case reflect.Map:
+		if reflected.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		val := reflected.MapIndex(reflect.ValueOf(segment).Convert(reflected.Type().Key()))
+		if !val.IsValid() {
+			return nil, false
+		}
+		return val.Interface(), true
+	case reflect.Struct:
+		structType := reflected.Type()
+		for i := 0; i < structType.NumField(); i++ {
+			field := structType.Field(i)
+			if field.PkgPath != "" {
+				// unexported field
+				continue
+			}
+			if jsonFieldName(field) == segment {
+				return reflected.Field(i).Interface(), true
+			}
+		}
+	}
+	return nil, false
+}
+
+func jsonFieldName(field reflect.StructField) string {
+	tag := field.Tag.Get("json")
+	if tag == "" {
+		return field.Name
+	}
+	name := strings.Split(tag, ",")[0]
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
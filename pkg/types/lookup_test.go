@@ -0,0 +1,58 @@
+package types
+
+import "testing"
+
+type lookupMetadata struct {
+	NamespaceName string            `json:"namespace_name,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	NoTag         string
+	hidden        string
+}
+
+func TestLookup(t *testing.T) {
+	record := &Record{
+		Fields: map[string]interface{}{
+			"log": "my log",
+			"kubernetes": lookupMetadata{
+				NamespaceName: "default",
+				Labels: map[string]string{
+					"app": "nginx",
+				},
+				NoTag:  "notag",
+				hidden: "hidden",
+			},
+			"pointer": &lookupMetadata{NamespaceName: "pointer"},
+			"nested": map[string]interface{}{
+				"level": 3,
+			},
+		},
+	}
+
+	testCases := []struct {
+		path     string
+		expected string
+		ok       bool
+	}{
+		{path: "log", expected: "my log", ok: true},
+		{path: "kubernetes.namespace_name", expected: "default", ok: true},
+		{path: "kubernetes.labels.app", expected: "nginx", ok: true},
+		{path: "kubernetes.NoTag", expected: "notag", ok: true},
+		{path: "pointer.namespace_name", expected: "pointer", ok: true},
+		{path: "nested.level", expected: "3", ok: true},
+		{path: "kubernetes.hidden", expected: "", ok: false},
+		{path: "kubernetes.labels.missing", expected: "", ok: false},
+		{path: "log.nested", expected: "", ok: false},
+		{path: "missing", expected: "", ok: false},
+		{path: "", expected: "", ok: false},
+	}
+
+	for _, testCase := range testCases {
+		val, ok := record.LookupString(testCase.path)
+		if ok != testCase.ok {
+			t.Errorf("Expected lookup of '%s' to return %t, but got %t", testCase.path, testCase.ok, ok)
+		}
+		if val != testCase.expected {
+			t.Errorf("Expected lookup of '%s' to be '%s', but got '%s'", testCase.path, testCase.expected, val)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package types
+
+// Fields holding the syslog severity and facility names of a record, e.g. warning and daemon
+const (
+	FieldSeverity = "severity"
+	FieldFacility = "facility"
+)
+
+// SeverityNames are the syslog severity names, by number (as used by journalctl --priority).
+var SeverityNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// FacilityNames are the syslog facility names, by number.
+var FacilityNames = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp",
+	"ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}